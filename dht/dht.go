@@ -0,0 +1,400 @@
+package dht
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Well known nodes used to join the DHT when the routing table is empty
+var DEFAULT_BOOTSTRAP_NODES = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// File the node ID and routing table are saved to, so the next run can
+// rejoin the DHT without the bootstrap nodes
+const DEFAULT_STATE_FILE = "dht.dat"
+
+// Number of nodes queried at once during a lookup
+const ALPHA = 3
+
+// The routing table is refreshed and saved periodically
+const REFRESH_INTERVAL = 15 * time.Minute
+
+var ErrNoNodes = errors.New("No DHT nodes to query")
+
+// A node of the mainline DHT (BEP 5), it answers the queries of other
+// nodes and looks up peers for torrents without a tracker
+type DHT struct {
+	mu				*sync.Mutex
+	Id				NodeId
+	Table			*RoutingTable
+	Port			int
+	StatePath		string
+	BootstrapNodes	[]string
+	conn			net.PacketConn
+	pending			map[string]pendingQuery
+	tokens			*tokenManager
+	peerStore		*peerStore
+	closed			chan struct{}
+	stopped			chan struct{}
+	maintained		chan struct{}
+}
+
+// Create a DHT node listening on the UDP port, restoring its node ID and
+// routing table from the state file if it exists
+func NewDHT(port int, statePath string) (*DHT, error) {
+	conn, listenErr := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	return NewDHTWithConn(conn, statePath), nil
+}
+
+// Create a DHT node on a connection shared with other UDP protocols, like
+// uTP on the port peers connect to
+func NewDHTWithConn(conn net.PacketConn, statePath string) *DHT {
+	d := &DHT{
+		mu: &sync.Mutex{},
+		Id: GenerateNodeId(),
+		Port: conn.LocalAddr().(*net.UDPAddr).Port,
+		StatePath: statePath,
+		BootstrapNodes: DEFAULT_BOOTSTRAP_NODES,
+		conn: conn,
+		pending: map[string]pendingQuery{},
+		tokens: newTokenManager(),
+		peerStore: newPeerStore(),
+		closed: make(chan struct{}),
+		stopped: make(chan struct{}),
+		maintained: make(chan struct{}),
+	}
+
+	nodes, loadErr := d.loadState()
+	if loadErr != nil && !errors.Is(loadErr, os.ErrNotExist) {
+		fmt.Println("Failed to load DHT state:", loadErr)
+	}
+	d.Table = NewRoutingTable(d.Id)
+	for _, node := range nodes {
+		d.Table.Insert(node.Id, node.Addr, false)
+	}
+
+	return d
+}
+
+// Begin answering queries and join the DHT in the background
+func (d *DHT) Start() {
+	go d.readLoop()
+	go d.maintain()
+}
+
+// Stop the node and save its routing table
+func (d *DHT) Close() {
+	close(d.closed)
+	d.conn.Close()
+	<-d.stopped
+	<-d.maintained
+
+	saveErr := d.saveState()
+	if saveErr != nil {
+		fmt.Println("Failed to save DHT state:", saveErr)
+	}
+}
+
+// Check if the node was closed
+func (d *DHT) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Join the DHT by asking the bootstrap nodes for the nodes closest to us,
+// then looking up our own ID to fill the routing table
+func (d *DHT) bootstrap(cancel <-chan struct{}) {
+	wg := &sync.WaitGroup{}
+	for _, address := range d.BootstrapNodes {
+		addr, resolveErr := net.ResolveUDPAddr("udp4", address)
+		if resolveErr != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, queryErr := d.query(addr, "find_node", map[string]interface{}{
+				"target": string(d.Id[:]),
+			})
+			if queryErr == nil {
+				d.addNodes(response)
+			}
+		}()
+	}
+	wg.Wait()
+
+	d.lookup(d.Id, false, cancel)
+}
+
+// Add the nodes a node returned to the routing table, they are only
+// considered good once they respond to us themselves
+func (d *DHT) addNodes(response map[string]interface{}) []*Node {
+	compact, _ := response["nodes"].(string)
+	nodes, decodeErr := DecodeCompactNodes(compact)
+	if decodeErr != nil {
+		return nil
+	}
+	for _, node := range nodes {
+		d.Table.Insert(node.Id, node.Addr, false)
+	}
+	return nodes
+}
+
+// Keep the routing table fresh until the node is closed, bootstrapping
+// again whenever too few nodes are responding
+func (d *DHT) maintain() {
+	defer close(d.maintained)
+
+	wait := time.Duration(0)
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if d.Table.GoodCount() < K {
+			d.bootstrap(nil)
+		} else {
+			d.lookup(GenerateNodeId(), false, nil)
+		}
+		if d.isClosed() {
+			return
+		}
+
+		saveErr := d.saveState()
+		if saveErr != nil {
+			fmt.Println("Failed to save DHT state:", saveErr)
+		}
+		wait = REFRESH_INTERVAL
+	}
+}
+
+// A node that responded during a lookup, along with the token it returned
+type lookupNode struct {
+	Node	*Node
+	Token	string
+}
+
+// Iteratively query the nodes closest to the target, moving closer to it
+// with the nodes each of them returns, until the closest K nodes have all
+// been queried. With getPeers the nodes are asked for the peers of the
+// target info hash instead. Returns the peers found in the compact format
+// and the closest nodes that responded. The lookup is abandoned between
+// rounds if cancel is closed
+func (d *DHT) lookup(target NodeId, getPeers bool, cancel <-chan struct{}) ([]string, []lookupNode) {
+	candidates := d.Table.Closest(target, K)
+	seen := map[NodeId]bool{d.Id: true}
+	for _, node := range candidates {
+		seen[node.Id] = true
+	}
+	queried := map[NodeId]bool{}
+	failed := map[NodeId]bool{}
+	responded := []lookupNode{}
+	peers := []string{}
+	seenPeers := map[string]bool{}
+
+	mu := &sync.Mutex{}
+	for {
+		select {
+		case <-cancel:
+			return peers, nil
+		case <-d.closed:
+			return peers, nil
+		default:
+		}
+
+		// Query the closest candidates not queried yet, among the closest
+		// K that did not fail
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].Id.CloserTo(target, candidates[j].Id)
+		})
+		round := []*Node{}
+		closest := 0
+		for _, node := range candidates {
+			if failed[node.Id] {
+				continue
+			}
+			if closest++; closest > K || len(round) == ALPHA {
+				break
+			}
+			if !queried[node.Id] {
+				round = append(round, node)
+				queried[node.Id] = true
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		wg := &sync.WaitGroup{}
+		for _, node := range round {
+			wg.Add(1)
+			go func(node *Node) {
+				defer wg.Done()
+
+				method := "find_node"
+				args := map[string]interface{}{"target": string(target[:])}
+				if getPeers {
+					method = "get_peers"
+					args = map[string]interface{}{"info_hash": string(target[:])}
+				}
+				response, queryErr := d.query(node.Addr, method, args)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if queryErr != nil {
+					failed[node.Id] = true
+					d.Table.Failed(node.Id)
+					return
+				}
+
+				token, _ := response["token"].(string)
+				responded = append(responded, lookupNode{Node: node, Token: token})
+				for _, node := range d.addNodes(response) {
+					if !seen[node.Id] {
+						seen[node.Id] = true
+						candidates = append(candidates, node)
+					}
+				}
+
+				values, _ := response["values"].([]interface{})
+				for _, value := range values {
+					peer, ok := value.(string)
+					if ok && (len(peer) == 6 || len(peer) == 18) && !seenPeers[peer] {
+						seenPeers[peer] = true
+						peers = append(peers, peer)
+					}
+				}
+			}(node)
+		}
+		wg.Wait()
+	}
+
+	sort.Slice(responded, func(i, j int) bool {
+		return responded[i].Node.Id.CloserTo(target, responded[j].Node.Id)
+	})
+	return peers, responded[:min(K, len(responded))]
+}
+
+// Look up the peers of the torrent with the info hash, returns them in
+// the compact format, 6 bytes each over IPv4 and 18 bytes each over IPv6
+func (d *DHT) GetPeers(infoHash [20]byte, cancel <-chan struct{}) ([]string, error) {
+	if len(d.Table.Closest(infoHash, 1)) == 0 {
+		d.bootstrap(cancel)
+	}
+	peers, responded := d.lookup(infoHash, true, cancel)
+	if len(responded) == 0 {
+		return nil, ErrNoNodes
+	}
+	return peers, nil
+}
+
+// Look up the peers of the torrent with the info hash, then announce to
+// the closest nodes that we accept connections for it on the port
+func (d *DHT) Announce(infoHash [20]byte, port int, cancel <-chan struct{}) ([]string, error) {
+	if len(d.Table.Closest(infoHash, 1)) == 0 {
+		d.bootstrap(cancel)
+	}
+	peers, responded := d.lookup(infoHash, true, cancel)
+	if len(responded) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, closest := range responded {
+		if closest.Token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(closest lookupNode) {
+			defer wg.Done()
+			d.query(closest.Node.Addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash[:]),
+				"port": port,
+				"token": closest.Token,
+			})
+		}(closest)
+	}
+	wg.Wait()
+
+	return peers, nil
+}
+
+// Ping the node at the address, adding it to the routing table if it
+// responds
+func (d *DHT) Ping(address string) error {
+	addr, resolveErr := net.ResolveUDPAddr("udp4", address)
+	if resolveErr != nil {
+		return resolveErr
+	}
+	_, queryErr := d.query(addr, "ping", map[string]interface{}{})
+	return queryErr
+}
+
+// Load the node ID and the nodes of the routing table from the state file
+func (d *DHT) loadState() ([]*Node, error) {
+	if d.StatePath == "" {
+		return nil, nil
+	}
+	data, readErr := os.ReadFile(d.StatePath)
+	if readErr != nil {
+		return nil, readErr
+	}
+	state, decodeErr := utils.DecodeBencodeDict(data)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	if id, ok := state["id"].(string); ok && len(id) == NODE_ID_LENGTH {
+		copy(d.Id[:], id)
+	}
+	compact, _ := state["nodes"].(string)
+	return DecodeCompactNodes(compact)
+}
+
+// Save the node ID and the nodes of the routing table to the state file,
+// writing to a temporary file first so a crash never leaves it truncated
+func (d *DHT) saveState() error {
+	if d.StatePath == "" {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	encodeErr := bencode.Marshal(&buffer, map[string]interface{}{
+		"id": string(d.Id[:]),
+		"nodes": EncodeCompactNodes(d.Table.Nodes()),
+	})
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	tmpPath := d.StatePath + ".tmp"
+	writeErr := os.WriteFile(tmpPath, buffer.Bytes(), 0644)
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tmpPath, d.StatePath)
+}
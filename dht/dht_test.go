@@ -0,0 +1,326 @@
+package dht
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"bytes"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Start a DHT node on a free loopback port, joining through the bootstrap
+// nodes provided
+func newTestNode(t *testing.T, bootstrapNodes []string) *DHT {
+	d, err := NewDHT(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.BootstrapNodes = bootstrapNodes
+	d.Start()
+	t.Cleanup(d.Close)
+	return d
+}
+
+func nodeAddress(d *DHT) string {
+	return (&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: d.Port}).String()
+}
+
+// Start a network of nodes on loopback, all joining through the first one
+func newTestNetwork(t *testing.T, size int) []*DHT {
+	first := newTestNode(t, nil)
+	nodes := []*DHT{first}
+	for i := 1; i < size; i++ {
+		nodes = append(nodes, newTestNode(t, []string{nodeAddress(first)}))
+	}
+
+	// Join in order, then let every node look itself up once the whole
+	// network is up, like the periodic refresh would
+	for _, d := range nodes[1:] {
+		d.bootstrap(nil)
+	}
+	for _, d := range nodes {
+		d.lookup(d.Id, false, nil)
+	}
+	return nodes
+}
+
+func hasNode(table *RoutingTable, id NodeId) (*Node, bool) {
+	for _, node := range table.Nodes() {
+		if node.Id == id {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+func TestPing(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+
+	if err := a.Ping(nodeAddress(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both nodes learn about each other, as seen nodes
+	if node, found := hasNode(a.Table, b.Id); !found || node.LastSeen.IsZero() {
+		t.Error("Expected the pinged node in the routing table")
+	}
+	if node, found := hasNode(b.Table, a.Id); !found || node.LastSeen.IsZero() {
+		t.Error("Expected the querying node in the routing table")
+	}
+
+	if err := a.Ping("127.0.0.1:1"); err == nil {
+		t.Error("Expected pinging a closed port to fail")
+	}
+}
+
+func TestFindNodeInsertsNodes(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	c := newTestNode(t, nil)
+
+	// b knows c, a only knows b
+	if err := b.Ping(nodeAddress(c)); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := net.ResolveUDPAddr("udp4", nodeAddress(b))
+	response, err := a.query(addr, "find_node", map[string]interface{}{"target": string(c.Id[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := a.addNodes(response)
+	found := false
+	for _, node := range nodes {
+		found = found || node.Id == c.Id
+	}
+	if !found {
+		t.Fatal("Expected find_node to return the target node")
+	}
+
+	// Nodes heard of from others are not considered seen yet
+	node, inserted := hasNode(a.Table, c.Id)
+	if !inserted {
+		t.Fatal("Expected the returned node in the routing table")
+	}
+	if !node.LastSeen.IsZero() {
+		t.Error("Expected the returned node to not be seen yet")
+	}
+	if node.Addr.Port != c.Port {
+		t.Errorf("Expected the returned node on port %d, got %d", c.Port, node.Addr.Port)
+	}
+}
+
+func TestAnnouncePeerToken(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	c := newTestNode(t, nil)
+	infoHash := GenerateNodeId()
+	addr, _ := net.ResolveUDPAddr("udp4", nodeAddress(b))
+
+	response, err := a.query(addr, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := response["token"].(string)
+	if !ok || token == "" {
+		t.Fatal("Expected get_peers to return a token")
+	}
+	if _, hasValues := response["values"]; hasValues {
+		t.Error("Expected no peers before anyone announced")
+	}
+
+	// Tokens are tied to the IP address of the node they were given to
+	if b.tokens.Validate(token, net.IPv4(10, 0, 0, 1)) {
+		t.Error("Expected the token to be invalid for another IP address")
+	}
+
+	_, err = a.query(addr, "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port": 6881,
+		"token": "invalid",
+	})
+	if err == nil || !strings.Contains(err.Error(), "Invalid token") {
+		t.Fatalf("Expected announce_peer with an invalid token to fail, got %v", err)
+	}
+
+	_, err = a.query(addr, "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port": 6881,
+		"token": token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err = c.query(addr, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := response["values"].([]interface{})
+	if len(values) != 1 || values[0] != "\x7f\x00\x00\x01\x1a\xe1" {
+		t.Errorf("Expected the announced peer 127.0.0.1:6881, got %q", values)
+	}
+}
+
+func TestLookupConverges(t *testing.T) {
+	nodes := newTestNetwork(t, 24)
+
+	target := GenerateNodeId()
+	searcher := nodes[len(nodes) - 1]
+	_, responded := searcher.lookup(target, false, nil)
+
+	// The lookup finds the K nodes closest to the target in the network
+	expected := []NodeId{}
+	for _, d := range nodes {
+		if d != searcher {
+			expected = append(expected, d.Id)
+		}
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].CloserTo(target, expected[j])
+	})
+	expected = expected[:K]
+
+	if len(responded) != K {
+		t.Fatalf("Expected %d closest nodes, got %d", K, len(responded))
+	}
+	for i, closest := range responded {
+		if closest.Node.Id != expected[i] {
+			t.Fatalf("Closest node %d is not the expected node", i)
+		}
+		if closest.Token != "" {
+			t.Error("Expected no tokens from a find_node lookup")
+		}
+	}
+
+	// Peers announced by one node are found by another
+	infoHash := GenerateNodeId()
+	if _, err := nodes[3].Announce(infoHash, 6881, nil); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := nodes[17].GetPeers(infoHash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != "\x7f\x00\x00\x01\x1a\xe1" {
+		t.Errorf("Expected the announced peer 127.0.0.1:6881, got %q", peers)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), DEFAULT_STATE_FILE)
+	d, err := NewDHT(0, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.BootstrapNodes = nil
+
+	saved := map[NodeId]int{}
+	for i := 0; i < 20; i++ {
+		id := GenerateNodeId()
+		port := 10000 + i
+		d.Table.Insert(id, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, true)
+		saved[id] = port
+	}
+	if err := d.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	d.conn.Close()
+
+	restored, err := NewDHT(0, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.conn.Close()
+
+	if restored.Id != d.Id {
+		t.Error("Expected the node ID to be restored")
+	}
+	nodes := restored.Table.Nodes()
+	if len(nodes) != len(d.Table.Nodes()) {
+		t.Fatalf("Expected %d nodes restored, got %d", len(d.Table.Nodes()), len(nodes))
+	}
+	for _, node := range nodes {
+		port, found := saved[node.Id]
+		if !found || node.Addr.Port != port || !node.Addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("Unexpected restored node %x at %v", node.Id, node.Addr)
+		}
+		if !node.LastSeen.IsZero() {
+			t.Error("Expected restored nodes to not be seen until they respond")
+		}
+	}
+}
+
+// Closing the node saves its routing table as well
+func TestCloseSavesState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), DEFAULT_STATE_FILE)
+	d, err := NewDHT(0, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.BootstrapNodes = nil
+	d.Start()
+	d.Table.Insert(GenerateNodeId(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}, true)
+	d.Close()
+
+	restored, err := NewDHT(0, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.conn.Close()
+	if restored.Id != d.Id || len(restored.Table.Nodes()) != 1 {
+		t.Error("Expected the state saved on close to be restored")
+	}
+}
+
+// Replies with the transaction ID of a query are only accepted from the
+// address that was queried
+func TestQueryIgnoresRepliesFromOtherAddresses(t *testing.T) {
+	a := newTestNode(t, nil)
+	queried, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer queried.Close()
+	forger, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer forger.Close()
+
+	go func() {
+		buffer := make([]byte, MAX_MESSAGE_SIZE)
+		n, from, readErr := queried.ReadFromUDP(buffer)
+		if readErr != nil {
+			return
+		}
+		query, _ := utils.DecodeBencodeDict(buffer[:n])
+		transactionId, _ := query["t"].(string)
+		if len(transactionId) != TRANSACTION_ID_LENGTH {
+			t.Errorf("Expected a %d byte transaction ID, got %q", TRANSACTION_ID_LENGTH, transactionId)
+		}
+
+		reply := func(conn *net.UDPConn, id NodeId) {
+			var encoded bytes.Buffer
+			bencode.Marshal(&encoded, map[string]interface{}{
+				"t": transactionId,
+				"y": KRPC_RESPONSE,
+				"r": map[string]interface{}{"id": string(id[:])},
+			})
+			conn.WriteToUDP(encoded.Bytes(), from)
+		}
+		reply(forger, NodeId{1})
+		time.Sleep(50 * time.Millisecond)
+		reply(queried, NodeId{2})
+	}()
+
+	response, err := a.query(queried.LocalAddr().(*net.UDPAddr), "ping", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NodeId{2}
+	if id, _ := response["id"].(string); id != string(expected[:]) {
+		t.Errorf("Expected the reply of the queried address, got node %x", id)
+	}
+}
@@ -0,0 +1,292 @@
+package dht
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Time allowed for a node to respond to a query, lookups query several
+// nodes at once so queries are not retried
+const QUERY_TIMEOUT = 2 * time.Second
+
+// Largest KRPC message we expect to receive
+const MAX_MESSAGE_SIZE = 4096
+
+// Random transaction IDs make it hard for other hosts to forge responses
+const TRANSACTION_ID_LENGTH = 4
+
+// KRPC message types and error codes (BEP 5)
+const (
+	KRPC_QUERY = "q"
+	KRPC_RESPONSE = "r"
+	KRPC_ERROR = "e"
+)
+const (
+	KRPC_ERROR_GENERIC = 201
+	KRPC_ERROR_PROTOCOL = 203
+	KRPC_ERROR_METHOD_UNKNOWN = 204
+)
+
+var ErrQueryTimeout = errors.New("DHT query timed out")
+var ErrInvalidResponse = errors.New("Invalid DHT response")
+
+// A response or error received for a query we sent
+type krpcReply struct {
+	Response	map[string]interface{}
+	Err			error
+}
+
+// A query waiting for its reply, which must come from the queried address
+type pendingQuery struct {
+	Addr	*net.UDPAddr
+	Replies	chan krpcReply
+}
+
+// Send a bencoded KRPC message to the address
+func (d *DHT) send(addr *net.UDPAddr, message map[string]interface{}) error {
+	var buffer bytes.Buffer
+	encodeErr := bencode.Marshal(&buffer, message)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	_, writeErr := d.conn.WriteTo(buffer.Bytes(), addr)
+	return writeErr
+}
+
+// Send a query to the node at the address and wait for its response. The
+// node is added to the routing table when it responds, and marked as
+// failed if it does not
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	replies := make(chan krpcReply, 1)
+	d.mu.Lock()
+	transactionId := d.newTransactionId()
+	d.pending[transactionId] = pendingQuery{Addr: addr, Replies: replies}
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, transactionId)
+		d.mu.Unlock()
+	}()
+
+	args["id"] = string(d.Id[:])
+	sendErr := d.send(addr, map[string]interface{}{
+		"t": transactionId,
+		"y": KRPC_QUERY,
+		"q": method,
+		"a": args,
+	})
+	if sendErr != nil {
+		return nil, sendErr
+	}
+
+	timer := time.NewTimer(QUERY_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		if reply.Err != nil {
+			return nil, reply.Err
+		}
+		id, ok := reply.Response["id"].(string)
+		if !ok || len(id) != NODE_ID_LENGTH {
+			return nil, ErrInvalidResponse
+		}
+		d.Table.Insert(NodeId([]byte(id)), addr, true)
+		return reply.Response, nil
+	case <-timer.C:
+		return nil, ErrQueryTimeout
+	case <-d.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Generate a random transaction ID that is not used by another query,
+// must be called while holding the node's lock
+func (d *DHT) newTransactionId() string {
+	for {
+		transactionId := make([]byte, TRANSACTION_ID_LENGTH)
+		rand.Read(transactionId)
+		if _, used := d.pending[string(transactionId)]; !used {
+			return string(transactionId)
+		}
+	}
+}
+
+// Read KRPC messages until the socket is closed, answering queries and
+// passing responses to the queries waiting for them
+func (d *DHT) readLoop() {
+	defer close(d.stopped)
+
+	buffer := make([]byte, MAX_MESSAGE_SIZE)
+	for {
+		n, from, readErr := d.conn.ReadFrom(buffer)
+		if readErr != nil {
+			if errors.Is(readErr, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		// Only IPv4 nodes are supported, the socket may be shared with uTP
+		// which also accepts IPv6 peers
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || addr.IP.To4() == nil {
+			continue
+		}
+
+		message, decodeErr := utils.DecodeBencodeDict(buffer[:n])
+		if decodeErr != nil {
+			continue
+		}
+		transactionId, _ := message["t"].(string)
+		msgType, _ := message["y"].(string)
+
+		switch msgType {
+		case KRPC_QUERY:
+			d.handleQuery(addr, transactionId, message)
+		case KRPC_RESPONSE, KRPC_ERROR:
+			d.mu.Lock()
+			pending, found := d.pending[transactionId]
+			d.mu.Unlock()
+
+			// Ignore replies from other addresses than the one queried
+			if !found || !pending.Addr.IP.Equal(addr.IP) || pending.Addr.Port != addr.Port {
+				continue
+			}
+
+			reply := krpcReply{}
+			if msgType == KRPC_RESPONSE {
+				response, ok := message["r"].(map[string]interface{})
+				if !ok {
+					reply.Err = ErrInvalidResponse
+				}
+				reply.Response = response
+			} else {
+				reply.Err = decodeKRPCError(message)
+			}
+
+			select {
+			case pending.Replies <- reply:
+			default:
+			}
+		}
+	}
+}
+
+// Get the error sent by a node as a list of the error code and message
+func decodeKRPCError(message map[string]interface{}) error {
+	details, _ := message["e"].([]interface{})
+	if len(details) == 2 {
+		if description, ok := details[1].(string); ok {
+			return errors.New("DHT error: " + description)
+		}
+	}
+	return errors.New("DHT error")
+}
+
+// Send a response to a query
+func (d *DHT) respond(addr *net.UDPAddr, transactionId string, response map[string]interface{}) {
+	response["id"] = string(d.Id[:])
+	d.send(addr, map[string]interface{}{
+		"t": transactionId,
+		"y": KRPC_RESPONSE,
+		"r": response,
+	})
+}
+
+// Send an error in response to a query
+func (d *DHT) respondError(addr *net.UDPAddr, transactionId string, code int, description string) {
+	d.send(addr, map[string]interface{}{
+		"t": transactionId,
+		"y": KRPC_ERROR,
+		"e": []interface{}{code, description},
+	})
+}
+
+// Answer a query from another node, the node is added to the routing
+// table unless it announced itself as read-only
+func (d *DHT) handleQuery(addr *net.UDPAddr, transactionId string, message map[string]interface{}) {
+	method, _ := message["q"].(string)
+	args, ok := message["a"].(map[string]interface{})
+	if !ok {
+		d.respondError(addr, transactionId, KRPC_ERROR_PROTOCOL, "Missing arguments")
+		return
+	}
+	id, ok := args["id"].(string)
+	if !ok || len(id) != NODE_ID_LENGTH {
+		d.respondError(addr, transactionId, KRPC_ERROR_PROTOCOL, "Invalid node ID")
+		return
+	}
+	if readOnly, _ := message["ro"].(int64); readOnly != 1 {
+		d.Table.Insert(NodeId([]byte(id)), addr, true)
+	}
+
+	switch method {
+	case "ping":
+		d.respond(addr, transactionId, map[string]interface{}{})
+
+	case "find_node":
+		target, ok := args["target"].(string)
+		if !ok || len(target) != NODE_ID_LENGTH {
+			d.respondError(addr, transactionId, KRPC_ERROR_PROTOCOL, "Invalid target")
+			return
+		}
+		closest := d.Table.Closest(NodeId([]byte(target)), K)
+		d.respond(addr, transactionId, map[string]interface{}{
+			"nodes": EncodeCompactNodes(closest),
+		})
+
+	case "get_peers":
+		infoHash, ok := args["info_hash"].(string)
+		if !ok || len(infoHash) != NODE_ID_LENGTH {
+			d.respondError(addr, transactionId, KRPC_ERROR_PROTOCOL, "Invalid info hash")
+			return
+		}
+
+		// Return the peers we know of, and the closest nodes either way
+		// so the lookup can continue
+		response := map[string]interface{}{
+			"token": d.tokens.Generate(addr.IP),
+			"nodes": EncodeCompactNodes(d.Table.Closest(NodeId([]byte(infoHash)), K)),
+		}
+		if values := d.peerStore.Get(NodeId([]byte(infoHash))); len(values) > 0 {
+			response["values"] = values
+		}
+		d.respond(addr, transactionId, response)
+
+	case "announce_peer":
+		infoHash, ok := args["info_hash"].(string)
+		if !ok || len(infoHash) != NODE_ID_LENGTH {
+			d.respondError(addr, transactionId, KRPC_ERROR_PROTOCOL, "Invalid info hash")
+			return
+		}
+		token, _ := args["token"].(string)
+		if !d.tokens.Validate(token, addr.IP) {
+			d.respondError(addr, transactionId, KRPC_ERROR_PROTOCOL, "Invalid token")
+			return
+		}
+
+		// The peer can ask for the port it sent the query from to be
+		// used, eg: when it is behind a NAT
+		port, _ := args["port"].(int64)
+		if impliedPort, _ := args["implied_port"].(int64); impliedPort == 1 {
+			port = int64(addr.Port)
+		}
+		peer, valid := encodeCompactPeer(addr, int(port))
+		if !valid {
+			d.respondError(addr, transactionId, KRPC_ERROR_PROTOCOL, "Invalid port")
+			return
+		}
+		d.peerStore.Add(NodeId([]byte(infoHash)), peer)
+		d.respond(addr, transactionId, map[string]interface{}{})
+
+	default:
+		d.respondError(addr, transactionId, KRPC_ERROR_METHOD_UNKNOWN, "Method unknown")
+	}
+}
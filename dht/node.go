@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// Length of a node ID and of the compact node info: the node ID followed
+// by its IPv4 address and 2 byte big-endian port
+const NODE_ID_LENGTH = 20
+const COMPACT_NODE_LENGTH = 26
+
+type NodeId [NODE_ID_LENGTH]byte
+
+// A DHT node we know about, along with how reliable it has been
+type Node struct {
+	Id			NodeId
+	Addr		*net.UDPAddr
+	LastSeen	time.Time // Last time the node responded to us or queried us
+	Failures	int       // Queries that timed out since it last responded
+}
+
+// Generate a random node ID
+func GenerateNodeId() NodeId {
+	var id NodeId
+	rand.Read(id[:])
+	return id
+}
+
+// Get the XOR distance between two node IDs
+func (id NodeId) Distance(other NodeId) NodeId {
+	var distance NodeId
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// Get the number of leading bits the two node IDs have in common
+func (id NodeId) CommonPrefixLength(other NodeId) int {
+	for i := range id {
+		if diff := id[i] ^ other[i]; diff != 0 {
+			return i * 8 + bits.LeadingZeros8(diff)
+		}
+	}
+	return NODE_ID_LENGTH * 8
+}
+
+// Check if this node ID is closer to the target than the other node ID
+func (id NodeId) CloserTo(target NodeId, other NodeId) bool {
+	distance := id.Distance(target)
+	otherDistance := other.Distance(target)
+	for i := range distance {
+		if distance[i] != otherDistance[i] {
+			return distance[i] < otherDistance[i]
+		}
+	}
+	return false
+}
+
+// Encode the nodes in the compact node info format, nodes without an IPv4
+// address are skipped
+func EncodeCompactNodes(nodes []*Node) string {
+	compact := []byte{}
+	for _, node := range nodes {
+		ip4 := node.Addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		compact = append(compact, node.Id[:]...)
+		compact = append(compact, ip4...)
+		compact = binary.BigEndian.AppendUint16(compact, uint16(node.Addr.Port))
+	}
+	return string(compact)
+}
+
+// Decode nodes in the compact node info format
+func DecodeCompactNodes(compact string) ([]*Node, error) {
+	if len(compact) % COMPACT_NODE_LENGTH != 0 {
+		return nil, errors.New("Compact node info has invalid length")
+	}
+
+	nodes := []*Node{}
+	for i := 0; i < len(compact); i += COMPACT_NODE_LENGTH {
+		nodeBytes := []byte(compact[i:i+COMPACT_NODE_LENGTH])
+		node := &Node{
+			Addr: &net.UDPAddr{
+				IP: net.IP(nodeBytes[20:24]),
+				Port: int(binary.BigEndian.Uint16(nodeBytes[24:26])),
+			},
+		}
+		copy(node.Id[:], nodeBytes[:20])
+		if node.Addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Encode a peer's IPv4 address and port in the compact peer format
+func encodeCompactPeer(addr *net.UDPAddr, port int) (string, bool) {
+	ip4 := addr.IP.To4()
+	if ip4 == nil || port <= 0 || port > 65535 {
+		return "", false
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte{}, ip4...), uint16(port))), true
+}
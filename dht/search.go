@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+)
+
+// Torrents are re-announced to the DHT every 15 minutes, peers can be
+// requested earlier but not more often than once a minute
+const SEARCH_INTERVAL = 15 * time.Minute
+const MIN_SEARCH_INTERVAL = 1 * time.Minute
+
+// Periodically looks up the peers of a torrent on the DHT in the
+// background and announces that we accept connections for it
+type Search struct {
+	dht			*DHT
+	infoHash	[20]byte
+	port		int
+	onPeers		func([]map[string]interface{})
+	needPeers	chan struct{}
+	stop		chan struct{}
+	stopped		chan struct{}
+}
+
+// Create a search for the torrent with the info hash, the peers found are
+// passed to onPeers in the same form as tracker responses, so they can be
+// added to the running swarm the same way
+func (d *DHT) NewSearch(infoHash [20]byte, port int, onPeers func([]map[string]interface{})) *Search {
+	return &Search{
+		dht: d,
+		infoHash: infoHash,
+		port: port,
+		onPeers: onPeers,
+		needPeers: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Begin searching in the background
+func (s *Search) Start() {
+	go s.run()
+}
+
+// Request an early search because the swarm ran out of peers
+func (s *Search) RequestPeers() {
+	select {
+	case s.needPeers <- struct{}{}:
+	default:
+	}
+}
+
+// Stop searching, abandoning a lookup in progress
+func (s *Search) Stop() {
+	close(s.stop)
+	<-s.stopped
+}
+
+// Search loop that runs until the search is stopped
+func (s *Search) run() {
+	defer close(s.stopped)
+
+	var wait time.Duration
+	var lastSearch time.Time
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.needPeers:
+			timer.Stop()
+			earliest := lastSearch.Add(MIN_SEARCH_INTERVAL)
+			if time.Now().Before(earliest) {
+				wait = time.Until(earliest)
+				continue
+			}
+		case <-timer.C:
+		}
+
+		peers, searchErr := s.dht.Announce(s.infoHash, s.port, s.stop)
+		lastSearch = time.Now()
+		wait = SEARCH_INTERVAL
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if searchErr != nil {
+			fmt.Println("DHT search failed, retrying in", MIN_SEARCH_INTERVAL, ":", searchErr)
+			wait = MIN_SEARCH_INTERVAL
+			continue
+		}
+
+		// Values are 6 bytes over IPv4 and 18 bytes over IPv6, passed on
+		// like the `peers` and `peers6` of tracker responses
+		if s.onPeers != nil && len(peers) > 0 {
+			peers4, peers6 := "", ""
+			for _, peer := range peers {
+				if len(peer) == 6 {
+					peers4 += peer
+				} else {
+					peers6 += peer
+				}
+			}
+			s.onPeers([]map[string]interface{}{{"peers": peers4, "peers6": peers6}})
+		}
+	}
+}
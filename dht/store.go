@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+)
+
+// The secret used for tokens changes every 5 minutes, and tokens from the
+// previous secret are still accepted, so a token is valid for 5 to 10
+// minutes after get_peers
+const TOKEN_SECRET_INTERVAL = 5 * time.Minute
+const TOKEN_LENGTH = 8
+
+// Peers announced to us are kept for 30 minutes unless they re-announce,
+// and only this many peers are kept and returned per torrent
+const PEER_TTL = 30 * time.Minute
+const MAX_STORED_PEERS = 100
+const MAX_RETURNED_PEERS = 50
+
+// Generates and validates the tokens returned by get_peers, which a node
+// must send back in announce_peer to prove it owns its IP address
+type tokenManager struct {
+	mu				*sync.Mutex
+	secret			[]byte
+	previousSecret	[]byte
+	rotatedAt		time.Time
+}
+
+func newTokenManager() *tokenManager {
+	return &tokenManager{
+		mu: &sync.Mutex{},
+		secret: generateSecret(),
+		previousSecret: generateSecret(),
+		rotatedAt: time.Now(),
+	}
+}
+
+func generateSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return secret
+}
+
+// Rotate the secret if it is due, must be called with the lock held
+func (tm *tokenManager) rotate() {
+	if time.Since(tm.rotatedAt) < TOKEN_SECRET_INTERVAL {
+		return
+	}
+	tm.previousSecret = tm.secret
+	tm.secret = generateSecret()
+	tm.rotatedAt = time.Now()
+}
+
+// Compute the token for the IP address with the secret
+func computeToken(secret []byte, ip net.IP) string {
+	hash := sha1.Sum(append(append([]byte{}, ip.To16()...), secret...))
+	return string(hash[:TOKEN_LENGTH])
+}
+
+// Generate a token for the IP address
+func (tm *tokenManager) Generate(ip net.IP) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate()
+	return computeToken(tm.secret, ip)
+}
+
+// Check that the token was generated for the IP address recently
+func (tm *tokenManager) Validate(token string, ip net.IP) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate()
+	for _, secret := range [][]byte{tm.secret, tm.previousSecret} {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(computeToken(secret, ip))) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// The peers other nodes announced to us, by info hash, along with the
+// time they were announced
+type peerStore struct {
+	mu		*sync.Mutex
+	peers	map[NodeId]map[string]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		mu: &sync.Mutex{},
+		peers: map[NodeId]map[string]time.Time{},
+	}
+}
+
+// Store a peer in the compact format announced for the info hash
+func (ps *peerStore) Add(infoHash NodeId, peer string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peers, found := ps.peers[infoHash]
+	if !found {
+		peers = map[string]time.Time{}
+		ps.peers[infoHash] = peers
+	}
+	if _, known := peers[peer]; !known && len(peers) >= MAX_STORED_PEERS {
+		return
+	}
+	peers[peer] = time.Now()
+}
+
+// Get the peers in the compact format announced for the info hash,
+// dropping the ones that expired
+func (ps *peerStore) Get(infoHash NodeId) []interface{} {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	values := []interface{}{}
+	for peer, announcedAt := range ps.peers[infoHash] {
+		if time.Since(announcedAt) > PEER_TTL {
+			delete(ps.peers[infoHash], peer)
+			continue
+		}
+		if len(values) < MAX_RETURNED_PEERS {
+			values = append(values, peer)
+		}
+	}
+	if len(ps.peers[infoHash]) == 0 {
+		delete(ps.peers, infoHash)
+	}
+	return values
+}
@@ -0,0 +1,147 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum number of nodes in each bucket of the routing table
+const K = 8
+
+// Nodes that failed to respond this many times in a row are replaced by
+// new nodes, and nodes not seen for a while are questionable
+const MAX_NODE_FAILURES = 2
+const NODE_QUESTIONABLE_AFTER = 15 * time.Minute
+
+// Kademlia routing table, nodes are placed in buckets by the number of
+// leading bits their ID has in common with ours, so we know many nodes
+// close to us and fewer nodes far away
+type RoutingTable struct {
+	mu		*sync.Mutex
+	Self	NodeId
+	buckets	[NODE_ID_LENGTH * 8][]*Node // Ordered from the least to the most recently seen
+}
+
+// Create an empty routing table for our node ID
+func NewRoutingTable(self NodeId) *RoutingTable {
+	return &RoutingTable{
+		mu: &sync.Mutex{},
+		Self: self,
+	}
+}
+
+// Get the bucket the node ID belongs to, returns -1 for our own ID
+func (rt *RoutingTable) bucketIndex(id NodeId) int {
+	prefix := rt.Self.CommonPrefixLength(id)
+	if prefix == len(rt.buckets) {
+		return -1
+	}
+	return prefix
+}
+
+// Add a node to the routing table or refresh it if it is already known.
+// If its bucket is full, it replaces a node that stopped responding, or
+// it is dropped. Nodes that were only heard of from others are added
+// with a zero LastSeen
+func (rt *RoutingTable) Insert(id NodeId, addr *net.UDPAddr, seen bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	index := rt.bucketIndex(id)
+	if index == -1 {
+		return
+	}
+	bucket := rt.buckets[index]
+
+	for i, node := range bucket {
+		if node.Id != id {
+			continue
+		}
+		if seen {
+			node.Addr = addr
+			node.LastSeen = time.Now()
+			node.Failures = 0
+			// Move it to the end as the most recently seen node
+			bucket = append(append(bucket[:i], bucket[i+1:]...), node)
+			rt.buckets[index] = bucket
+		}
+		return
+	}
+
+	node := &Node{Id: id, Addr: addr}
+	if seen {
+		node.LastSeen = time.Now()
+	}
+
+	if len(bucket) < K {
+		rt.buckets[index] = append(bucket, node)
+		return
+	}
+
+	for i, existing := range bucket {
+		if existing.Failures >= MAX_NODE_FAILURES {
+			rt.buckets[index] = append(append(bucket[:i], bucket[i+1:]...), node)
+			return
+		}
+	}
+}
+
+// Record that the node failed to respond to a query
+func (rt *RoutingTable) Failed(id NodeId) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	index := rt.bucketIndex(id)
+	if index == -1 {
+		return
+	}
+	for _, node := range rt.buckets[index] {
+		if node.Id == id {
+			node.Failures++
+		}
+	}
+}
+
+// Get copies of up to count nodes closest to the target, skipping the
+// nodes that stopped responding
+func (rt *RoutingTable) Closest(target NodeId, count int) []*Node {
+	nodes := []*Node{}
+	for _, node := range rt.Nodes() {
+		if node.Failures < MAX_NODE_FAILURES {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Id.CloserTo(target, nodes[j].Id)
+	})
+	return nodes[:min(count, len(nodes))]
+}
+
+// Get copies of all the nodes in the routing table
+func (rt *RoutingTable) Nodes() []*Node {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	nodes := []*Node{}
+	for _, bucket := range rt.buckets {
+		for _, node := range bucket {
+			nodeCopy := *node
+			nodes = append(nodes, &nodeCopy)
+		}
+	}
+	return nodes
+}
+
+// Get the number of nodes that are not questionable
+func (rt *RoutingTable) GoodCount() int {
+	count := 0
+	for _, node := range rt.Nodes() {
+		if node.Failures == 0 && time.Since(node.LastSeen) < NODE_QUESTIONABLE_AFTER {
+			count++
+		}
+	}
+	return count
+}
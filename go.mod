@@ -2,4 +2,4 @@ module github.com/yusuf-musleh/lit-torrent
 
 go 1.21.3
 
-require github.com/jackpal/bencode-go v1.0.0 // indirect
+require github.com/jackpal/bencode-go v1.0.0
@@ -0,0 +1,288 @@
+package lsd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multicast groups announcements are sent to and received on, over IPv4
+// and IPv6 (BEP 14)
+const MULTICAST_ADDRESS = "239.192.152.143:6771"
+const MULTICAST_ADDRESS6 = "[ff15::efc0:988f]:6771"
+
+// Torrents are announced every 5 minutes, and never more often than once
+// a minute
+const ANNOUNCE_INTERVAL = 5 * time.Minute
+const MIN_ANNOUNCE_INTERVAL = 1 * time.Minute
+
+// Announcements fit in a single datagram, larger ones are ignored
+const MAX_MESSAGE_SIZE = 1400
+
+// Info hashes announced in a single message
+const MAX_ANNOUNCE_INFO_HASHES = 16
+
+const COOKIE_LENGTH = 8
+
+var ErrInvalidAnnouncement = errors.New("Invalid LSD announcement")
+
+// A multicast group we joined, announcements are sent from a separate
+// socket so other clients on the same machine receive them too
+type group struct {
+	Addr	*net.UDPAddr
+	listen	*net.UDPConn
+	send	*net.UDPConn
+}
+
+// A torrent announced on the local network
+type torrent struct {
+	onPeers			func([]map[string]interface{})
+	lastAnnounce	time.Time
+}
+
+// Local Service Discovery, announces the torrents we have on the local
+// network over multicast and finds the peers announcing the same ones
+type LSD struct {
+	mu				*sync.Mutex
+	wg				*sync.WaitGroup
+	Port			int // Port peers connect to us on
+	cookie			string
+	groups			[]*group
+	torrents		map[[20]byte]*torrent
+	needAnnounce	chan struct{}
+	closed			chan struct{}
+}
+
+// Join the LSD multicast groups, at least one of them must be joined
+func NewLSD(port int) (*LSD, error) {
+	cookieBytes := make([]byte, COOKIE_LENGTH / 2)
+	rand.Read(cookieBytes)
+
+	l := &LSD{
+		mu: &sync.Mutex{},
+		wg: &sync.WaitGroup{},
+		Port: port,
+		cookie: hex.EncodeToString(cookieBytes),
+		torrents: map[[20]byte]*torrent{},
+		needAnnounce: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+	var joinErr error
+	for _, address := range []string{MULTICAST_ADDRESS, MULTICAST_ADDRESS6} {
+		g, err := joinGroup(address)
+		if err != nil {
+			joinErr = err
+			continue
+		}
+		l.groups = append(l.groups, g)
+	}
+	if len(l.groups) == 0 {
+		return nil, joinErr
+	}
+	return l, nil
+}
+
+// Listen on the multicast group and open the socket to announce to it
+func joinGroup(address string) (*group, error) {
+	network := "udp4"
+	if strings.HasPrefix(address, "[") {
+		network = "udp6"
+	}
+
+	addr, resolveErr := net.ResolveUDPAddr(network, address)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	listen, listenErr := net.ListenMulticastUDP(network, nil, addr)
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	send, sendErr := net.ListenUDP(network, nil)
+	if sendErr != nil {
+		listen.Close()
+		return nil, sendErr
+	}
+	return &group{Addr: addr, listen: listen, send: send}, nil
+}
+
+// Announce the torrent with the info hash on the local network, the peers
+// announcing it are passed to onPeers in the same form as tracker
+// responses, so they can be added to the running swarm the same way
+func (l *LSD) Register(infoHash [20]byte, onPeers func([]map[string]interface{})) {
+	l.mu.Lock()
+	l.torrents[infoHash] = &torrent{onPeers: onPeers}
+	l.mu.Unlock()
+
+	select {
+	case l.needAnnounce <- struct{}{}:
+	default:
+	}
+}
+
+// Begin announcing and listening for announcements in the background
+func (l *LSD) Start() {
+	l.wg.Add(1 + len(l.groups))
+	go l.announceLoop()
+	for _, g := range l.groups {
+		go l.readLoop(g)
+	}
+}
+
+// Stop announcing and leave the multicast groups
+func (l *LSD) Close() {
+	close(l.closed)
+	for _, g := range l.groups {
+		g.listen.Close()
+		g.send.Close()
+	}
+	l.wg.Wait()
+}
+
+// Announce the torrents that are due, until closed
+func (l *LSD) announceLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(MIN_ANNOUNCE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		l.announce()
+		select {
+		case <-l.closed:
+			return
+		case <-l.needAnnounce:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send an announcement for the torrents not announced in the last
+// ANNOUNCE_INTERVAL to each group
+func (l *LSD) announce() {
+	l.mu.Lock()
+	now := time.Now()
+	due := [][20]byte{}
+	for infoHash, t := range l.torrents {
+		if now.Sub(t.lastAnnounce) >= ANNOUNCE_INTERVAL {
+			t.lastAnnounce = now
+			due = append(due, infoHash)
+		}
+	}
+	l.mu.Unlock()
+
+	for start := 0; start < len(due); start += MAX_ANNOUNCE_INFO_HASHES {
+		infoHashes := due[start:min(start + MAX_ANNOUNCE_INFO_HASHES, len(due))]
+		for _, g := range l.groups {
+			message := EncodeAnnouncement(g.Addr.String(), l.Port, infoHashes, l.cookie)
+			g.send.WriteToUDP(message, g.Addr)
+		}
+	}
+}
+
+// Read announcements from the group until closed, passing the peer that
+// sent it to the torrents we registered
+func (l *LSD) readLoop(g *group) {
+	defer l.wg.Done()
+
+	buffer := make([]byte, MAX_MESSAGE_SIZE)
+	for {
+		n, addr, readErr := g.listen.ReadFromUDP(buffer)
+		if readErr != nil {
+			if errors.Is(readErr, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		port, infoHashes, cookie, parseErr := ParseAnnouncement(buffer[:n])
+		if parseErr != nil || cookie == l.cookie {
+			continue
+		}
+
+		// Link-local IPv6 peers are only reachable through the interface
+		// the announcement came from
+		ip := addr.IP.String()
+		if addr.Zone != "" {
+			ip += "%" + addr.Zone
+		}
+		peers := []map[string]interface{}{{
+			"peers": []interface{}{
+				map[string]interface{}{"ip": ip, "port": int64(port)},
+			},
+		}}
+		for _, infoHash := range infoHashes {
+			l.mu.Lock()
+			t, found := l.torrents[infoHash]
+			l.mu.Unlock()
+			if found && t.onPeers != nil {
+				t.onPeers(peers)
+			}
+		}
+	}
+}
+
+// Encode the announcement of the info hashes, sent to the group at the
+// host address
+func EncodeAnnouncement(host string, port int, infoHashes [][20]byte, cookie string) []byte {
+	var message bytes.Buffer
+	message.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&message, "Host: %s\r\n", host)
+	fmt.Fprintf(&message, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&message, "Infohash: %s\r\n", hex.EncodeToString(infoHash[:]))
+	}
+	if cookie != "" {
+		fmt.Fprintf(&message, "cookie: %s\r\n", cookie)
+	}
+	message.WriteString("\r\n\r\n")
+	return message.Bytes()
+}
+
+// Parse an announcement, returns the port the peer accepts connections
+// on along with the info hashes it announced and its cookie
+func ParseAnnouncement(data []byte) (int, [][20]byte, string, error) {
+	lines := strings.Split(string(data), "\n")
+	if !strings.HasPrefix(lines[0], "BT-SEARCH * HTTP/1.1") {
+		return 0, nil, "", ErrInvalidAnnouncement
+	}
+
+	port := 0
+	infoHashes := [][20]byte{}
+	cookie := ""
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "port":
+			parsed, portErr := strconv.Atoi(value)
+			if portErr != nil || parsed <= 0 || parsed > 65535 {
+				return 0, nil, "", ErrInvalidAnnouncement
+			}
+			port = parsed
+		case "infohash":
+			decoded, hexErr := hex.DecodeString(value)
+			if hexErr != nil || len(decoded) != 20 {
+				continue
+			}
+			infoHashes = append(infoHashes, [20]byte(decoded))
+		case "cookie":
+			cookie = value
+		}
+	}
+
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", ErrInvalidAnnouncement
+	}
+	return port, infoHashes, cookie, nil
+}
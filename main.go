@@ -3,51 +3,346 @@ package main
 import (
 	T "github.com/yusuf-musleh/lit-torrent/torrent"
 	P "github.com/yusuf-musleh/lit-torrent/peers"
+	"github.com/yusuf-musleh/lit-torrent/dht"
+	"github.com/yusuf-musleh/lit-torrent/lsd"
+	"github.com/yusuf-musleh/lit-torrent/mse"
+	"github.com/yusuf-musleh/lit-torrent/utp"
 
+	"flag"
+	"net"
 	"os"
+	"os/signal"
 	"fmt"
-	"sync"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 func main() {
 	command := os.Args[1]
 
 	if command == "download" {
-		if len(os.Args) != 3 {
-			fmt.Println("No .torrent file arg provided")
+		flags := flag.NewFlagSet("download", flag.ExitOnError)
+		pickerMode := flags.String(
+			"picker",
+			T.PICKER_RAREST_FIRST,
+			"Piece selection strategy: rarest-first or sequential",
+		)
+		pipelineDepth := flags.Int(
+			"pipeline",
+			P.DEFAULT_PIPELINE_DEPTH,
+			"Minimum number of block requests in flight per peer",
+		)
+		maxPipelineDepth := flags.Int(
+			"max-pipeline",
+			P.DEFAULT_MAX_PIPELINE_DEPTH,
+			"Maximum number of block requests in flight per peer, adapted to the peer's download rate",
+		)
+		port := flags.Int("port", T.DEFAULT_PORT, "Port to accept incoming peer connections on")
+		saveTorrentPath := flags.String(
+			"save-torrent",
+			"",
+			"Save the metadata fetched for a magnet URI as a .torrent file at this path",
+		)
+		enableDHT, bootstrapNodes := addDHTFlags(flags)
+		encryption := addEncryptionFlag(flags)
+		enableUTP := addUTPFlag(flags)
+		enableLSD := addLSDFlag(flags)
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 {
+			fmt.Println("No .torrent file or magnet URI arg provided")
+			os.Exit(1)
+		}
+		parseEncryptionFlag(*encryption)
+
+		picker, pickerErr := T.NewPiecePicker(*pickerMode)
+		if pickerErr != nil {
+			fmt.Println(pickerErr)
 			os.Exit(1)
 		}
-		torrent, filePiecesQueue, file := T.ParseTorrentFile(os.Args[2])
-		defer file.Close()
 
-		// While there are still file pieces to process in the queue,
-		// and there are no longer any active connections with peers,
-		// keep fetching and connecting to peers to download them
-		// TODO: We can improve this by making use of the `interval` that
-		// is returned from `AnnounceToTracker`.
-		for len(filePiecesQueue.FilePieces) > 0 {
-			// Announce to Tracker to get available peers
-			_, data := torrent.AnnounceToTracker()
-			peers, currentPeerCount := P.ParsePeersFromTracker(data)
+		var torrent T.Torrent
+		var filePiecesQueue T.FilePiecesQueue
+		var storage T.DownloadStorage
+		var dhtNode *dht.DHT
+		var utpSocket *utp.Socket
+		if *enableUTP {
+			utpSocket = startUTP(*port)
+		}
+		initialPeers := []P.Peer{}
+		if strings.HasPrefix(flags.Arg(0), "magnet:") {
+			magnet, magnetErr := T.ParseMagnet(flags.Arg(0))
+			if magnetErr != nil {
+				fmt.Println("Invalid magnet URI:", magnetErr)
+				os.Exit(1)
+			}
 
-			// Establish connections to all available Peers in parallel
-			fmt.Println("Connecting to peers...")
-			var wg sync.WaitGroup
-			for i := range peers {
-				wg.Add(1)
-				go peers[i].Connect(
-					torrent.InfoHash,
-					torrent.PeerId,
-					&wg,
-					&filePiecesQueue,
-					&file,
-					&currentPeerCount,
-				)
+			// The info dictionary is fetched from peers first, then the
+			// download continues like it would with a .torrent file. Whether
+			// the torrent is private is unknown until then
+			if *enableDHT {
+				dhtNode = startDHT(*port, utpSocket, *bootstrapNodes)
+			}
+			torrent, initialPeers = fetchMagnetTorrent(magnet, *port, dhtNode, *encryption, utpSocket)
+			if *saveTorrentPath != "" {
+				saveErr := os.WriteFile(*saveTorrentPath, torrent.Bytes(), 0644)
+				if saveErr != nil {
+					fmt.Println("Failed to save .torrent file:", saveErr)
+				}
 			}
+			selectedFiles, ignoredFiles, selectErr := magnet.SelectedFiles(&torrent)
+			if len(ignoredFiles) > 0 {
+				fmt.Println("Ignoring file selections past the last file:", ignoredFiles)
+			}
+			if selectErr != nil {
+				fmt.Println("Invalid file selection:", selectErr)
+				os.Exit(1)
+			}
+			torrent, filePiecesQueue, storage = T.PrepareDownload(torrent, selectedFiles)
+		} else {
+			torrent, filePiecesQueue, storage = T.ParseTorrentFile(flags.Arg(0))
+		}
+		defer storage.Close()
+		filePiecesQueue.Picker = picker
+		torrent.Port = *port
+
+		// Private torrents must only get peers from their trackers
+		allowsDHT := torrent.AllowsPeerSource(T.PEER_SOURCE_DHT)
+		if !allowsDHT && dhtNode != nil {
+			dhtNode.Close()
+			dhtNode = nil
+		} else if allowsDHT && *enableDHT && dhtNode == nil {
+			dhtNode = startDHT(*port, utpSocket, *bootstrapNodes)
+		}
+
+		// Connections to peers are managed by the swarm, peers can be
+		// added to it at any point while the download is running
+		swarm := P.NewSwarm(&torrent, &filePiecesQueue, &storage)
+		swarm.PipelineDepth = max(*pipelineDepth, 1)
+		swarm.MaxPipelineDepth = max(*maxPipelineDepth, swarm.PipelineDepth)
+		swarm.Encryption = *encryption
+		swarm.UTP = utpSocket
+
+		// Serve the pieces we completed to peers that connect to us, the
+		// download continues without it if the port is unavailable
+		listener := P.NewListener(torrent.Port)
+		listener.Encryption = *encryption
+		listener.UTP = utpSocket
+		listener.Register(swarm)
+		listenErr := listener.Start()
+		if listenErr != nil {
+			fmt.Println("Not accepting incoming connections:", listenErr)
+		}
+		defer listener.Close()
+
+		// Save the progress periodically so an interrupted download can
+		// be resumed without rechecking, and reconnect to the peers known
+		// from the last run
+		resumeSaver := T.NewResumeSaver(&torrent, &filePiecesQueue, swarm.KnownPeers)
+
+		// Re-announce to the Trackers in the background based on the
+		// `interval` they return, feeding newly discovered peers into
+		// the running swarm
+		announcer := T.NewAnnouncer(&torrent, addPeersFrom(swarm, T.PEER_SOURCE_TRACKER))
+		swarm.OnPeersExhausted = announcer.RequestPeers
+
+		// Look up peers on the DHT as well, they are added to the swarm
+		// like the peers returned by the Trackers
+		var search *dht.Search
+		if dhtNode != nil {
+			search = dhtNode.NewSearch(torrent.InfoHash, torrent.Port, addPeersFrom(swarm, T.PEER_SOURCE_DHT))
+			swarm.OnPeersExhausted = func() {
+				announcer.RequestPeers()
+				search.RequestPeers()
+			}
+		}
+		fmt.Println("Connecting to peers...")
+		swarm.Start()
+		resumeSaver.Start()
+		if torrent.Resume != nil {
+			swarm.AddPeers(T.PEER_SOURCE_RESUME, P.ParseCompactPeers(torrent.Resume.Peers, net.IPv4len))
+			swarm.AddPeers(T.PEER_SOURCE_RESUME, P.ParseCompactPeers(torrent.Resume.Peers6, net.IPv6len))
+		}
+		swarm.AddPeers(T.PEER_SOURCE_MAGNET, initialPeers)
+		announcer.Start()
+		if search != nil {
+			search.Start()
+		}
+
+		// Find peers on the local network too, unless the torrent is private
+		var lsdNode *lsd.LSD
+		if *enableLSD && torrent.AllowsPeerSource(T.PEER_SOURCE_LSD) {
+			lsdNode = startLSD(torrent.Port)
+		}
+		if lsdNode != nil {
+			lsdNode.Register(torrent.InfoHash, addPeersFrom(swarm, T.PEER_SOURCE_LSD))
+		}
+
+		// Wait for the download to complete, or to be interrupted
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-filePiecesQueue.Done():
+			fmt.Println("Download complete:", torrent.Info.Name)
+			announcer.Completed()
+		case <-signals:
+			fmt.Println("Download interrupted, stopping...")
+		}
+
+		swarm.Close()
+		resumeSaver.Stop()
+		announcer.Stop()
+		if dhtNode != nil {
+			if search != nil {
+				search.Stop()
+			}
+			dhtNode.Close()
+		}
+		if lsdNode != nil {
+			lsdNode.Close()
+		}
+		if utpSocket != nil {
+			utpSocket.Close()
+		}
+
+	} else if command == "seed" {
+		flags := flag.NewFlagSet("seed", flag.ExitOnError)
+		port := flags.Int("port", T.DEFAULT_PORT, "Port to accept incoming peer connections on")
+		enableDHT, bootstrapNodes := addDHTFlags(flags)
+		encryption := addEncryptionFlag(flags)
+		enableUTP := addUTPFlag(flags)
+		enableLSD := addLSDFlag(flags)
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 {
+			fmt.Println("No .torrent file arg provided")
+			os.Exit(1)
+		}
+		parseEncryptionFlag(*encryption)
+
+		torrent, filePiecesQueue, storage := T.ParseTorrentFileForSeeding(flags.Arg(0))
+		defer storage.Close()
+		torrent.Port = *port
+
+		var utpSocket *utp.Socket
+		if *enableUTP {
+			utpSocket = startUTP(torrent.Port)
+		}
+
+		swarm := P.NewSwarm(&torrent, &filePiecesQueue, &storage)
+		swarm.Encryption = *encryption
+		swarm.UTP = utpSocket
+
+		listener := P.NewListener(torrent.Port)
+		listener.Encryption = *encryption
+		listener.UTP = utpSocket
+		listener.Register(swarm)
+		listenErr := listener.Start()
+		if listenErr != nil {
+			fmt.Println("Failed to accept incoming connections:", listenErr)
+			os.Exit(1)
+		}
+
+		// Keep announcing to the Trackers so peers can find us, and
+		// connect to the peers they return as well
+		announcer := T.NewAnnouncer(&torrent, addPeersFrom(swarm, T.PEER_SOURCE_TRACKER))
+		swarm.Start()
+		announcer.Start()
+
+		// Announce to the DHT too, unless the torrent is private
+		var dhtNode *dht.DHT
+		var search *dht.Search
+		if *enableDHT && torrent.AllowsPeerSource(T.PEER_SOURCE_DHT) {
+			dhtNode = startDHT(torrent.Port, utpSocket, *bootstrapNodes)
+		}
+		if dhtNode != nil {
+			search = dhtNode.NewSearch(torrent.InfoHash, torrent.Port, addPeersFrom(swarm, T.PEER_SOURCE_DHT))
+			search.Start()
+		}
+
+		// Announce on the local network as well, unless the torrent is
+		// private
+		var lsdNode *lsd.LSD
+		if *enableLSD && torrent.AllowsPeerSource(T.PEER_SOURCE_LSD) {
+			lsdNode = startLSD(torrent.Port)
+		}
+		if lsdNode != nil {
+			lsdNode.Register(torrent.InfoHash, addPeersFrom(swarm, T.PEER_SOURCE_LSD))
+		}
+
+		// Seed until interrupted
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		fmt.Println("Seeding interrupted, stopping...")
+
+		listener.Close()
+		swarm.Close()
+		announcer.Stop()
+		if dhtNode != nil {
+			search.Stop()
+			dhtNode.Close()
+		}
+		if lsdNode != nil {
+			lsdNode.Close()
+		}
+		if utpSocket != nil {
+			utpSocket.Close()
+		}
 
-			// Blocks on all go routines with peer connections in this
-			// batch until they terminate
-			wg.Wait()
+	} else if command == "verify" {
+		if len(os.Args) < 3 {
+			fmt.Println("No .torrent file arg provided")
+			os.Exit(1)
+		}
+
+		torrent, verified := T.VerifyTorrentFile(os.Args[2])
+		pieceCount := len(torrent.Info.Pieces) / 20
+		fmt.Printf("Valid pieces: %d/%d\n", verified.Count(), pieceCount)
+		if verified.Count() != pieceCount {
+			missing := verified.Ranges(pieceCount, false)
+			fmt.Println("Missing or corrupted pieces:", strings.Join(missing, ", "))
+			os.Exit(1)
+		}
+
+	} else if command == "scrape" {
+		if len(os.Args) < 3 {
+			fmt.Println("No .torrent file arg provided")
+			os.Exit(1)
+		}
+
+		// Query every tracker of the torrent for its seeders and leechers,
+		// without connecting to any peers
+		torrent := T.LoadTorrentFile(os.Args[2])
+		scrapes := torrent.ScrapeTrackers()
+		if len(scrapes) == 0 {
+			fmt.Println("No trackers in the .torrent file")
+			os.Exit(1)
+		}
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "TRACKER\tSEEDERS\tLEECHERS\tDOWNLOADED\tERROR")
+		failed := 0
+		for _, scrape := range scrapes {
+			if scrape.Err != nil {
+				fmt.Fprintf(table, "%s\t-\t-\t-\t%v\n", scrape.Tracker, scrape.Err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(
+				table,
+				"%s\t%d\t%d\t%d\t\n",
+				scrape.Tracker,
+				scrape.Result.Complete,
+				scrape.Result.Incomplete,
+				scrape.Result.Downloaded,
+			)
+		}
+		table.Flush()
+		if failed == len(scrapes) {
+			os.Exit(1)
 		}
 
 	} else {
@@ -55,3 +350,143 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// Add the peers found through the source to the swarm, they are passed in
+// the same form as tracker responses
+func addPeersFrom(swarm *P.Swarm, source string) func([]map[string]interface{}) {
+	return func(peersData []map[string]interface{}) {
+		swarm.AddPeers(source, P.ParsePeersFromTrackers(peersData))
+	}
+}
+
+// Add the flags to enable the DHT and to set its bootstrap nodes
+func addDHTFlags(flags *flag.FlagSet) (*bool, *string) {
+	enableDHT := flags.Bool("dht", true, "Find peers on the DHT, never used for private torrents")
+	bootstrapNodes := flags.String(
+		"dht-bootstrap",
+		strings.Join(dht.DEFAULT_BOOTSTRAP_NODES, ","),
+		"Comma separated host:port addresses of the nodes used to join the DHT",
+	)
+	return enableDHT, bootstrapNodes
+}
+
+// Add the flag to choose the encryption policy of peer connections
+func addEncryptionFlag(flags *flag.FlagSet) *string {
+	return flags.String(
+		"encryption",
+		mse.POLICY_PREFER,
+		"Encryption of peer connections: disabled, prefer (falling back to plaintext) or require",
+	)
+}
+
+// Exit if the encryption policy is not valid
+func parseEncryptionFlag(policy string) {
+	_, policyErr := mse.ParsePolicy(policy)
+	if policyErr != nil {
+		fmt.Println(policyErr)
+		os.Exit(1)
+	}
+}
+
+// Add the flag to connect to peers over uTP as well as TCP
+func addUTPFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("utp", true, "Connect to peers over uTP as well as TCP, keeping whichever connects first")
+}
+
+// Add the flag to find peers on the local network
+func addLSDFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("lsd", true, "Find peers on the local network with multicast announcements, never used for private torrents")
+}
+
+// Join the local service discovery multicast groups and begin announcing,
+// returns nil if multicast is unavailable
+func startLSD(port int) *lsd.LSD {
+	lsdNode, lsdErr := lsd.NewLSD(port)
+	if lsdErr != nil {
+		fmt.Println("Not using local service discovery:", lsdErr)
+		return nil
+	}
+	lsdNode.Start()
+	return lsdNode
+}
+
+// Open the uTP socket on the UDP port, the same as the port peers connect
+// to over TCP, returns nil if the port is unavailable
+func startUTP(port int) *utp.Socket {
+	utpSocket, listenErr := utp.Listen(port)
+	if listenErr != nil {
+		fmt.Println("Not using uTP:", listenErr)
+		return nil
+	}
+	return utpSocket
+}
+
+// Start a DHT node on the UDP port, the same as the port peers connect
+// to, sharing the uTP socket if there is one. Returns nil if the port is
+// unavailable
+func startDHT(port int, utpSocket *utp.Socket, bootstrapNodes string) *dht.DHT {
+	var dhtNode *dht.DHT
+	if utpSocket != nil {
+		dhtNode = dht.NewDHTWithConn(utpSocket.PacketConn(), dht.DEFAULT_STATE_FILE)
+	} else {
+		var dhtErr error
+		dhtNode, dhtErr = dht.NewDHT(port, dht.DEFAULT_STATE_FILE)
+		if dhtErr != nil {
+			fmt.Println("Not using the DHT:", dhtErr)
+			return nil
+		}
+	}
+	dhtNode.BootstrapNodes = strings.Split(bootstrapNodes, ",")
+	dhtNode.Start()
+	return dhtNode
+}
+
+// Fetch the info dictionary of the magnet's torrent from the peers returned
+// by its trackers and the DHT, and the peers in the magnet URI, retrying
+// until it succeeds. Returns the torrent along with the peers found
+func fetchMagnetTorrent(
+	magnet T.Magnet,
+	port int,
+	dhtNode *dht.DHT,
+	encryption string,
+	utpSocket *utp.Socket,
+) (T.Torrent, []P.Peer) {
+	magnetTorrent := magnet.Torrent()
+	magnetTorrent.Port = port
+	fmt.Println("Fetching metadata:", magnet.Name)
+
+	magnetPeers := []P.Peer{}
+	for _, address := range magnet.Peers {
+		peer, addressErr := P.ParsePeerAddress(address)
+		if addressErr == nil {
+			magnetPeers = append(magnetPeers, peer)
+		}
+	}
+
+	for {
+		peers := append([]P.Peer{}, magnetPeers...)
+		_, _, responses, announceErr := magnetTorrent.AnnounceToTrackers("")
+		if announceErr == nil {
+			peers = append(peers, P.ParsePeersFromTrackers(responses)...)
+		}
+		if dhtNode != nil {
+			dhtPeers, dhtErr := dhtNode.GetPeers(magnetTorrent.InfoHash, nil)
+			if dhtErr == nil {
+				peers = append(peers, P.ParseCompactPeerValues(dhtPeers)...)
+			}
+		}
+
+		rawInfo, fetchErr := P.FetchMetadata(magnetTorrent.InfoHash, magnetTorrent.PeerId, peers, encryption, utpSocket)
+		if fetchErr == nil {
+			torrent, torrentErr := magnet.TorrentFromMetadata(rawInfo, magnetTorrent.PeerId)
+			if torrentErr == nil {
+				torrent.Port = port
+				return torrent, peers
+			}
+			fetchErr = torrentErr
+		}
+
+		fmt.Println(fetchErr, "retrying...")
+		time.Sleep(T.MIN_ANNOUNCE_RETRY)
+	}
+}
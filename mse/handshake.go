@@ -0,0 +1,254 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Verification constant sent encrypted by both sides, 8 zero bytes
+var VC = make([]byte, 8)
+
+var ErrSyncFailed = errors.New("Failed to find the MSE synchronization marker")
+var ErrNoCryptoMethod = errors.New("No crypto method supported by both sides")
+var ErrUnknownTorrent = errors.New("MSE handshake for an unknown torrent")
+
+// Read the other side's bytes until the marker, which follows up to
+// MAX_PAD_LENGTH bytes of padding
+func readUntil(reader io.Reader, marker []byte) error {
+	window := []byte{}
+	b := make([]byte, 1)
+	for len(window) < MAX_PAD_LENGTH + len(marker) {
+		_, readErr := io.ReadFull(reader, b)
+		if readErr != nil {
+			return readErr
+		}
+		window = append(window, b[0])
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return ErrSyncFailed
+}
+
+// Read and decrypt exactly len(b) bytes
+func readDecrypted(reader io.Reader, decrypt *rc4.Cipher, b []byte) error {
+	_, readErr := io.ReadFull(reader, b)
+	if readErr != nil {
+		return readErr
+	}
+	decrypt.XORKeyStream(b, b)
+	return nil
+}
+
+// Read and decrypt a 2 byte length followed by that many bytes
+func readDecryptedPrefixed(reader io.Reader, decrypt *rc4.Cipher, maxLength int) ([]byte, error) {
+	lengthBytes := make([]byte, 2)
+	readErr := readDecrypted(reader, decrypt, lengthBytes)
+	if readErr != nil {
+		return nil, readErr
+	}
+	length := int(binary.BigEndian.Uint16(lengthBytes))
+	if length > maxLength {
+		return nil, errors.New("Invalid MSE length")
+	}
+	data := make([]byte, length)
+	return data, readDecrypted(reader, decrypt, data)
+}
+
+// Perform the MSE handshake as the side that opened the connection to the
+// peer, offering the crypto methods allowed by the policy. The torrent's
+// info hash is the shared key `SKEY`. Returns the connection to use from
+// then on, encrypted unless the peer selected plaintext
+func Initiate(conn net.Conn, infoHash [20]byte, policy string) (*Conn, error) {
+	keys, keyErr := generateKeyPair()
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	_, writeErr := conn.Write(append(append([]byte{}, keys.public...), randomPad(MAX_PAD_LENGTH)...))
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	otherPublic := make([]byte, DH_KEY_LENGTH)
+	_, readErr := io.ReadFull(conn, otherPublic)
+	if readErr != nil {
+		return nil, readErr
+	}
+	secret, secretErr := keys.sharedSecret(otherPublic)
+	if secretErr != nil {
+		return nil, secretErr
+	}
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	encrypt := newCipher("keyA", secret, infoHash)
+	decrypt := newCipher("keyB", secret, infoHash)
+
+	skeyHash := hash([]byte("req2"), infoHash[:])
+	obfuscated := hash([]byte("req3"), secret)
+	for i := range skeyHash {
+		skeyHash[i] ^= obfuscated[i]
+	}
+
+	provide := make([]byte, 4)
+	binary.BigEndian.PutUint32(provide, uint32(allowedMethods(policy)))
+	plain := append(append([]byte{}, VC...), provide...)
+	plain = append(plain, 0, 0) // No PadC
+	plain = append(plain, 0, 0) // No initial payload, the handshake follows
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+
+	message := append(hash([]byte("req1"), secret), skeyHash...)
+	_, writeErr = conn.Write(append(message, encrypted...))
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), found by
+	// looking for the encrypted VC after PadB
+	encryptedVC := make([]byte, len(VC))
+	newCipher("keyB", secret, infoHash).XORKeyStream(encryptedVC, VC)
+	syncErr := readUntil(conn, encryptedVC)
+	if syncErr != nil {
+		return nil, syncErr
+	}
+	decrypt.XORKeyStream(make([]byte, len(VC)), VC)
+
+	selectBytes := make([]byte, 4)
+	readErr = readDecrypted(conn, decrypt, selectBytes)
+	if readErr != nil {
+		return nil, readErr
+	}
+	_, readErr = readDecryptedPrefixed(conn, decrypt, MAX_PAD_LENGTH)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	method := int(binary.BigEndian.Uint32(selectBytes))
+	if method != CRYPTO_RC4 && method != CRYPTO_PLAINTEXT || method & allowedMethods(policy) == 0 {
+		return nil, ErrNoCryptoMethod
+	}
+
+	mseConn := &Conn{Conn: conn, Method: method, mu: &sync.Mutex{}}
+	if method == CRYPTO_RC4 {
+		mseConn.encrypt = encrypt
+		mseConn.decrypt = decrypt
+	}
+	return mseConn, nil
+}
+
+// Perform the MSE handshake as the side that accepted the connection,
+// after its first bytes were already read to tell it apart from a
+// plaintext handshake. The info hash is found among the torrents we
+// serve with findInfoHash, which is given `HASH('req2', SKEY)`. Returns
+// the connection along with the info hash, the first reads return the
+// initial payload sent by the peer, usually its handshake
+func Receive(
+	conn net.Conn,
+	prefix []byte,
+	policy string,
+	findInfoHash func(skeyHash []byte) ([20]byte, bool),
+) (*Conn, [20]byte, error) {
+	var infoHash [20]byte
+	reader := io.MultiReader(bytes.NewReader(prefix), conn)
+
+	keys, keyErr := generateKeyPair()
+	if keyErr != nil {
+		return nil, infoHash, keyErr
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	otherPublic := make([]byte, DH_KEY_LENGTH)
+	_, readErr := io.ReadFull(reader, otherPublic)
+	if readErr != nil {
+		return nil, infoHash, readErr
+	}
+	secret, secretErr := keys.sharedSecret(otherPublic)
+	if secretErr != nil {
+		return nil, infoHash, secretErr
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	_, writeErr := conn.Write(append(append([]byte{}, keys.public...), randomPad(MAX_PAD_LENGTH)...))
+	if writeErr != nil {
+		return nil, infoHash, writeErr
+	}
+
+	// 3 A->B: HASH('req1', S) found after PadA, followed by
+	// HASH('req2', SKEY) xor HASH('req3', S) identifying the torrent
+	syncErr := readUntil(reader, hash([]byte("req1"), secret))
+	if syncErr != nil {
+		return nil, infoHash, syncErr
+	}
+	skeyHash := make([]byte, 20)
+	_, readErr = io.ReadFull(reader, skeyHash)
+	if readErr != nil {
+		return nil, infoHash, readErr
+	}
+	obfuscated := hash([]byte("req3"), secret)
+	for i := range skeyHash {
+		skeyHash[i] ^= obfuscated[i]
+	}
+	infoHash, found := findInfoHash(skeyHash)
+	if !found {
+		return nil, infoHash, ErrUnknownTorrent
+	}
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	decrypt := newCipher("keyA", secret, infoHash)
+	encrypt := newCipher("keyB", secret, infoHash)
+
+	header := make([]byte, len(VC) + 4)
+	readErr = readDecrypted(reader, decrypt, header)
+	if readErr != nil {
+		return nil, infoHash, readErr
+	} else if !bytes.Equal(header[:len(VC)], VC) {
+		return nil, infoHash, errors.New("Invalid MSE verification constant")
+	}
+	provide := int(binary.BigEndian.Uint32(header[len(VC):]))
+
+	_, readErr = readDecryptedPrefixed(reader, decrypt, MAX_PAD_LENGTH)
+	if readErr != nil {
+		return nil, infoHash, readErr
+	}
+	initialPayload, readErr := readDecryptedPrefixed(reader, decrypt, 65535)
+	if readErr != nil {
+		return nil, infoHash, readErr
+	}
+
+	// Prefer RC4 whenever both sides allow it
+	supported := provide & allowedMethods(policy)
+	method := CRYPTO_RC4
+	if supported & CRYPTO_RC4 == 0 {
+		method = CRYPTO_PLAINTEXT
+	}
+	if supported & method == 0 {
+		return nil, infoHash, ErrNoCryptoMethod
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	plain := append([]byte{}, VC...)
+	plain = binary.BigEndian.AppendUint32(plain, uint32(method))
+	plain = append(plain, 0, 0) // No PadD
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+	_, writeErr = conn.Write(encrypted)
+	if writeErr != nil {
+		return nil, infoHash, writeErr
+	}
+
+	mseConn := &Conn{Conn: conn, Method: method, mu: &sync.Mutex{}, pending: initialPayload}
+	if method == CRYPTO_RC4 {
+		mseConn.encrypt = encrypt
+		mseConn.decrypt = decrypt
+	}
+	return mseConn, infoHash, nil
+}
@@ -0,0 +1,163 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Open a TCP connection on loopback, returning both of its ends
+func newLoopbackConns(t *testing.T) (net.Conn, net.Conn) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+
+	initiator, dialErr := net.Dial("tcp", listener.Addr().String())
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	receiver, acceptErr := listener.Accept()
+	if acceptErr != nil {
+		t.Fatal(acceptErr)
+	}
+	t.Cleanup(func() {
+		initiator.Close()
+		receiver.Close()
+	})
+
+	// A failed handshake must not leave the other side waiting forever
+	deadline := time.Now().Add(5 * time.Second)
+	initiator.SetDeadline(deadline)
+	receiver.SetDeadline(deadline)
+	return initiator, receiver
+}
+
+// Find the info hash among the torrents served, like the listener does
+func serving(infoHashes ...[20]byte) func(skeyHash []byte) ([20]byte, bool) {
+	return func(skeyHash []byte) ([20]byte, bool) {
+		for _, infoHash := range infoHashes {
+			if bytes.Equal(hash([]byte("req2"), infoHash[:]), skeyHash) {
+				return infoHash, true
+			}
+		}
+		return [20]byte{}, false
+	}
+}
+
+type handshakeResult struct {
+	conn		*Conn
+	infoHash	[20]byte
+	err			error
+}
+
+// Perform the handshake between both ends of a loopback connection with
+// the policies provided, the receiver serving the torrents provided
+func handshake(
+	t *testing.T,
+	infoHash [20]byte,
+	initiatorPolicy string,
+	receiverPolicy string,
+	served ...[20]byte,
+) (*Conn, handshakeResult, error) {
+	initiator, receiver := newLoopbackConns(t)
+
+	received := make(chan handshakeResult, 1)
+	go func() {
+		conn, infoHash, err := Receive(receiver, nil, receiverPolicy, serving(served...))
+		if err != nil {
+			// The initiator only finds out once the connection is closed
+			receiver.Close()
+		}
+		received <- handshakeResult{conn, infoHash, err}
+	}()
+
+	conn, err := Initiate(initiator, infoHash, initiatorPolicy)
+	if err != nil {
+		initiator.Close()
+	}
+	return conn, <-received, err
+}
+
+// Exchange data over both connections in both directions
+func checkTransfer(t *testing.T, a *Conn, b *Conn) {
+	for _, direction := range [][2]*Conn{{a, b}, {b, a}} {
+		message := []byte("\x13BitTorrent protocol")
+		go direction[0].Write(message)
+		received := make([]byte, len(message))
+		if _, err := io.ReadFull(direction[1], received); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, message) {
+			t.Fatalf("Expected %q, got %q", message, received)
+		}
+	}
+}
+
+func TestHandshakePolicies(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	tests := []struct {
+		initiator	string
+		receiver	string
+		method		int
+	}{
+		{POLICY_PREFER, POLICY_PREFER, CRYPTO_RC4},
+		{POLICY_REQUIRE, POLICY_REQUIRE, CRYPTO_RC4},
+		{POLICY_PREFER, POLICY_REQUIRE, CRYPTO_RC4},
+		{POLICY_REQUIRE, POLICY_PREFER, CRYPTO_RC4},
+		{POLICY_PREFER, POLICY_DISABLED, CRYPTO_PLAINTEXT},
+		{POLICY_DISABLED, POLICY_PREFER, CRYPTO_PLAINTEXT},
+		{POLICY_DISABLED, POLICY_DISABLED, CRYPTO_PLAINTEXT},
+	}
+
+	for _, test := range tests {
+		initiated, received, err := handshake(t, infoHash, test.initiator, test.receiver, infoHash)
+		if err != nil || received.err != nil {
+			t.Fatalf("%s to %s: handshake failed: %v, %v", test.initiator, test.receiver, err, received.err)
+		}
+		if received.infoHash != infoHash {
+			t.Errorf("%s to %s: expected the info hash to be found", test.initiator, test.receiver)
+		}
+		if initiated.Method != test.method || received.conn.Method != test.method {
+			t.Errorf(
+				"%s to %s: expected method %d, got %d and %d",
+				test.initiator, test.receiver, test.method, initiated.Method, received.conn.Method,
+			)
+		}
+
+		// Only RC4 encrypts the stream after the handshake
+		if encrypted := initiated.encrypt != nil; encrypted != (test.method == CRYPTO_RC4) {
+			t.Errorf("%s to %s: expected encryption to match method %d", test.initiator, test.receiver, test.method)
+		}
+		checkTransfer(t, initiated, received.conn)
+	}
+}
+
+func TestHandshakeNoCommonMethod(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	for _, policies := range [][2]string{
+		{POLICY_REQUIRE, POLICY_DISABLED},
+		{POLICY_DISABLED, POLICY_REQUIRE},
+	} {
+		_, received, err := handshake(t, infoHash, policies[0], policies[1], infoHash)
+		if received.err != ErrNoCryptoMethod {
+			t.Errorf("%s to %s: expected the receiver to fail with %v, got %v", policies[0], policies[1], ErrNoCryptoMethod, received.err)
+		}
+		if err == nil {
+			t.Errorf("%s to %s: expected the initiator to fail", policies[0], policies[1])
+		}
+	}
+}
+
+func TestHandshakeUnknownInfoHash(t *testing.T) {
+	_, received, err := handshake(t, [20]byte{1, 2, 3}, POLICY_PREFER, POLICY_PREFER, [20]byte{4, 5, 6})
+	if received.err != ErrUnknownTorrent {
+		t.Errorf("Expected the receiver to reject the info hash, got %v", received.err)
+	}
+	if err == nil {
+		t.Error("Expected the initiator to fail")
+	}
+}
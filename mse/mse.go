@@ -0,0 +1,161 @@
+package mse
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Encryption policies for peer connections: never encrypt, encrypt when
+// the peer supports it and fall back to plaintext otherwise, or only
+// accept encrypted connections
+const (
+	POLICY_DISABLED = "disabled"
+	POLICY_PREFER = "prefer"
+	POLICY_REQUIRE = "require"
+)
+
+// Crypto methods offered in `crypto_provide` and chosen in `crypto_select`
+const CRYPTO_PLAINTEXT = 0x01
+const CRYPTO_RC4 = 0x02
+
+// The 768 bit prime and generator of the Diffie-Hellman key exchange
+const DH_PRIME_HEX = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74" +
+	"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437" +
+	"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563"
+const DH_GENERATOR = 2
+const DH_KEY_LENGTH = 96
+const DH_PRIVATE_KEY_LENGTH = 20
+
+// Each side sends up to 512 bytes of random padding after its public key
+const MAX_PAD_LENGTH = 512
+
+// The first 1024 bytes of each RC4 keystream are discarded
+const RC4_DISCARD = 1024
+
+var dhPrime, _ = new(big.Int).SetString(DH_PRIME_HEX, 16)
+
+var ErrInvalidPolicy = errors.New("Invalid encryption policy, must be disabled, prefer or require")
+
+// Validate an encryption policy
+func ParsePolicy(policy string) (string, error) {
+	switch policy {
+	case POLICY_DISABLED, POLICY_PREFER, POLICY_REQUIRE:
+		return policy, nil
+	}
+	return "", ErrInvalidPolicy
+}
+
+// Get the crypto methods allowed by the policy
+func allowedMethods(policy string) int {
+	switch policy {
+	case POLICY_REQUIRE:
+		return CRYPTO_RC4
+	case POLICY_PREFER:
+		return CRYPTO_RC4 | CRYPTO_PLAINTEXT
+	}
+	return CRYPTO_PLAINTEXT
+}
+
+// A Diffie-Hellman key pair
+type keyPair struct {
+	private	*big.Int
+	public	[]byte
+}
+
+// Generate a random private key and its public key
+func generateKeyPair() (keyPair, error) {
+	privateBytes := make([]byte, DH_PRIVATE_KEY_LENGTH)
+	_, randErr := rand.Read(privateBytes)
+	if randErr != nil {
+		return keyPair{}, randErr
+	}
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(big.NewInt(DH_GENERATOR), private, dhPrime)
+	return keyPair{private: private, public: padKey(public)}, nil
+}
+
+// Compute the shared secret from the other side's public key
+func (kp keyPair) sharedSecret(otherPublic []byte) ([]byte, error) {
+	other := new(big.Int).SetBytes(otherPublic)
+	if other.Cmp(big.NewInt(1)) <= 0 || other.Cmp(dhPrime) >= 0 {
+		return nil, errors.New("Invalid public key")
+	}
+	return padKey(new(big.Int).Exp(other, kp.private, dhPrime)), nil
+}
+
+// Encode a key as a big-endian number padded to 96 bytes
+func padKey(key *big.Int) []byte {
+	return key.FillBytes(make([]byte, DH_KEY_LENGTH))
+}
+
+// SHA1 of the concatenated values, `HASH` in the specification
+func hash(values ...[]byte) []byte {
+	hasher := sha1.New()
+	for _, value := range values {
+		hasher.Write(value)
+	}
+	return hasher.Sum(nil)
+}
+
+// Create the RC4 cipher for one direction of the stream, keyed with
+// `HASH('keyA', S, SKEY)` or `HASH('keyB', S, SKEY)`
+func newCipher(keyName string, secret []byte, skey [20]byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(keyName), secret, skey[:]))
+	discard := make([]byte, RC4_DISCARD)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+// Generate random padding of a random length up to the maximum
+func randomPad(maxLength int) []byte {
+	lengthBytes := make([]byte, 2)
+	rand.Read(lengthBytes)
+	pad := make([]byte, (int(lengthBytes[0]) << 8 | int(lengthBytes[1])) % (maxLength + 1))
+	rand.Read(pad)
+	return pad
+}
+
+// A connection after the MSE handshake, encrypting and decrypting the
+// stream with RC4 if it was selected. The initial payload sent along with
+// the handshake is returned by the first reads
+type Conn struct {
+	net.Conn
+	Method		int // The crypto method that was selected
+	mu			*sync.Mutex
+	pending		[]byte
+	encrypt		*rc4.Cipher
+	decrypt		*rc4.Cipher
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write the data, encrypting it into a copy so the caller's buffer is left
+// untouched. Writes are serialized to keep the keystream in sync
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	encrypted := make([]byte, len(b))
+	c.encrypt.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
@@ -0,0 +1,225 @@
+package peers
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DEFAULT_UPLOAD_SLOTS = 4
+
+// The choker re-evaluates which peers are unchoked every round, and picks
+// a new optimistic unchoke every few rounds
+const CHOKE_INTERVAL = 10 * time.Second
+const OPTIMISTIC_UNCHOKE_ROUNDS = 3
+
+// Peers we are interested in that have not sent us a block in this long
+// are considered snubbing us, and are only unchoked optimistically
+const SNUB_TIMEOUT = 60 * time.Second
+
+// Recently connected peers are more likely to be picked for the optimistic
+// unchoke, so they get pieces to share sooner
+const NEW_PEER_WINDOW = 60 * time.Second
+const NEW_PEER_WEIGHT = 3
+
+// Decides which peers we upload to using tit-for-tat: the peers sending
+// to us the fastest are unchoked, plus one optimistic unchoke to discover
+// better peers. When seeding, the peers we upload to the fastest are
+// unchoked instead
+type Choker struct {
+	mu			*sync.Mutex
+	swarm		*Swarm
+	Slots		int // Maximum number of peers unchoked at once
+	optimistic	*Peer
+	round		int
+	lastTotals	map[*Peer]int // Bytes transferred as of the last round
+	lastRound	time.Time
+	stop		chan struct{}
+	stopped		chan struct{}
+}
+
+// A snapshot of the state of a peer used to decide whether to unchoke it
+type chokerPeer struct {
+	Peer		*Peer
+	Interested	bool
+	Snubbed		bool
+	New			bool
+	Total		int // Bytes transferred to or from the peer so far
+	Rate		float64
+}
+
+// Create the choker for the swarm, it does not run until started
+func NewChoker(swarm *Swarm) *Choker {
+	return &Choker{
+		mu: &sync.Mutex{},
+		swarm: swarm,
+		Slots: DEFAULT_UPLOAD_SLOTS,
+		lastTotals: map[*Peer]int{},
+		lastRound: time.Now(),
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Begin re-evaluating the unchoked peers every round in the background
+func (c *Choker) Start() {
+	go c.run()
+}
+
+// Stop the choker and wait for it to terminate
+func (c *Choker) Stop() {
+	close(c.stop)
+	<-c.stopped
+}
+
+func (c *Choker) run() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(CHOKE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.rechoke()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Take a snapshot of the peers ready to exchange messages, along with
+// their transfer rate since the last round. When seeding the rate we
+// upload to them is used, otherwise the rate they send to us
+func (c *Choker) snapshot(elapsed time.Duration) []chokerPeer {
+	seeding := c.swarm.FilePiecesQueue.IsComplete()
+	now := time.Now()
+
+	snapshots := []chokerPeer{}
+	for _, peer := range c.swarm.readyPeers() {
+		peer.mu.Lock()
+		connection := peer.Connection
+		peer.mu.Unlock()
+
+		total := connection.Downloaded
+		if seeding {
+			total = connection.Uploaded
+		}
+		rate := float64(max(total - c.lastTotals[peer], 0)) / elapsed.Seconds()
+
+		snapshots = append(snapshots, chokerPeer{
+			Peer: peer,
+			Interested: connection.PeerInterested,
+			Snubbed: !seeding &&
+				connection.AmInterested &&
+				now.Sub(connection.LastBlockAt) > SNUB_TIMEOUT,
+			New: now.Sub(connection.ConnectedAt) < NEW_PEER_WINDOW,
+			Total: total,
+			Rate: rate,
+		})
+	}
+	return snapshots
+}
+
+// Pick a random choked, interested peer for the optimistic unchoke,
+// recently connected peers are weighted higher
+func pickOptimistic(peers []chokerPeer, exclude map[*Peer]bool) *Peer {
+	candidates := []*Peer{}
+	for _, peer := range peers {
+		if !peer.Interested || exclude[peer.Peer] {
+			continue
+		}
+		weight := 1
+		if peer.New {
+			weight = NEW_PEER_WEIGHT
+		}
+		for i := 0; i < weight; i++ {
+			candidates = append(candidates, peer.Peer)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// Unchoke the interested peers with the best rates along with the
+// optimistic unchoke, and choke everyone else
+func (c *Choker) rechoke() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elapsed := max(time.Since(c.lastRound), time.Second)
+	c.lastRound = time.Now()
+	peers := c.snapshot(elapsed)
+
+	// Remember the totals to measure the rates of the next round
+	c.lastTotals = map[*Peer]int{}
+	for _, peer := range peers {
+		c.lastTotals[peer.Peer] = peer.Total
+	}
+
+	// Peers that snub us are left for the optimistic unchoke
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].Rate > peers[j].Rate
+	})
+	unchoke := map[*Peer]bool{}
+	regularSlots := max(c.Slots - 1, 1)
+	for _, peer := range peers {
+		if len(unchoke) >= regularSlots {
+			break
+		}
+		if peer.Interested && !peer.Snubbed {
+			unchoke[peer.Peer] = true
+		}
+	}
+
+	// Rotate the optimistic unchoke every few rounds, or right away if
+	// the previous one disconnected or lost interest
+	optimisticValid := false
+	for _, peer := range peers {
+		if peer.Peer == c.optimistic && peer.Interested {
+			optimisticValid = true
+		}
+	}
+	if !optimisticValid || c.round % OPTIMISTIC_UNCHOKE_ROUNDS == 0 {
+		c.optimistic = pickOptimistic(peers, unchoke)
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+	c.round++
+
+	for _, peer := range peers {
+		if unchoke[peer.Peer] {
+			peer.Peer.Unchoke()
+		} else {
+			peer.Peer.Choke()
+		}
+	}
+}
+
+// Unchoke a peer that became interested right away if there is a free
+// slot, instead of waiting for the next round. A peer that lost interest
+// is choked so its slot can be used by others
+func (c *Choker) handleInterest(peer *Peer, interested bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !interested {
+		peer.Choke()
+		return
+	}
+
+	unchoked := 0
+	for _, other := range c.swarm.readyPeers() {
+		if !other.isChoking() {
+			unchoked++
+		}
+	}
+	if unchoked < c.Slots {
+		peer.Unchoke()
+	}
+}
@@ -0,0 +1,92 @@
+package peers
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/mse"
+	"github.com/yusuf-musleh/lit-torrent/utp"
+
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net"
+	"time"
+)
+
+// Open a connection to the peer following the encryption policy: with
+// `prefer` the MSE handshake is tried first, and if the peer does not
+// support it the peer is dialed again for a plaintext connection. The
+// BitTorrent handshake is then sent over the returned connection
+func dialPeer(
+	address string,
+	infoHash [20]byte,
+	policy string,
+	utpSocket *utp.Socket,
+	timeout time.Duration,
+) (net.Conn, error) {
+	conn, connErr := dialTransport(address, utpSocket, timeout)
+	if connErr != nil || policy == mse.POLICY_DISABLED {
+		return conn, connErr
+	}
+
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	mseConn, mseErr := mse.Initiate(conn, infoHash, policy)
+	if mseErr == nil {
+		conn.SetDeadline(time.Time{})
+		return mseConn, nil
+	}
+	conn.Close()
+
+	if policy == mse.POLICY_REQUIRE {
+		return nil, mseErr
+	}
+	return dialTransport(address, utpSocket, timeout)
+}
+
+// Read the start of an incoming connection, either a plaintext handshake or
+// an MSE handshake depending on the encryption policy. Returns the
+// connection to use from then on along with the peer's handshake
+func (l *Listener) acceptHandshake(conn net.Conn) (net.Conn, []byte, error) {
+	// A plaintext handshake starts with the protocol name, anything else
+	// is the public key of an MSE handshake
+	prefix := make([]byte, 1 + len(BITTORRENT_PROTOCOL))
+	_, readErr := io.ReadFull(conn, prefix)
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+
+	plaintext := prefix[0] == byte(len(BITTORRENT_PROTOCOL)) &&
+		string(prefix[1:]) == BITTORRENT_PROTOCOL
+	if plaintext && l.Encryption == mse.POLICY_REQUIRE ||
+		!plaintext && l.Encryption == mse.POLICY_DISABLED {
+		return nil, nil, mse.ErrNoCryptoMethod
+	}
+
+	var peerConn net.Conn = conn
+	var reader io.Reader = io.MultiReader(bytes.NewReader(prefix), conn)
+	if !plaintext {
+		mseConn, _, mseErr := mse.Receive(conn, prefix, l.Encryption, l.findInfoHash)
+		if mseErr != nil {
+			return nil, nil, mseErr
+		}
+		peerConn = mseConn
+		reader = mseConn
+	}
+
+	handshake := make([]byte, HANDSHAKE_LENGTH)
+	_, readErr = io.ReadFull(reader, handshake)
+	return peerConn, handshake, readErr
+}
+
+// Find the info hash of the registered torrent matching the hash an MSE
+// handshake identifies it with
+func (l *Listener) findInfoHash(skeyHash []byte) ([20]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for infoHash := range l.swarms {
+		hash := sha1.Sum(append([]byte("req2"), infoHash[:]...))
+		if bytes.Equal(hash[:], skeyHash) {
+			return infoHash, true
+		}
+	}
+	return [20]byte{}, false
+}
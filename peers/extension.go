@@ -0,0 +1,301 @@
+package peers
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Support for the extension protocol (BEP 10) is advertised by a bit in
+// the reserved bytes of the handshake
+const EXTENSION_PROTOCOL_BYTE = 5
+const EXTENSION_PROTOCOL_BIT = 0x10
+
+// Extension message ID of the extended handshake
+const EXTENDED_HANDSHAKE_ID = 0
+
+// Client name and version sent in the extended handshake
+const CLIENT_VERSION = "lit-torrent 1.0"
+
+// Number of outstanding requests we accept from a peer, sent as `reqq`
+const DEFAULT_REQUEST_QUEUE = 250
+
+var ErrExtensionNotSupported = errors.New("Peer does not support the extension")
+
+// An extension plugged into the extension protocol by name, the peer's
+// messages for it are routed to it by the ID we assigned it
+type Extension interface {
+	Name() string
+	// Called once the peer's extended handshake was received, if the peer
+	// supports the extension
+	HandleHandshake(p *Peer, swarm *Swarm, handshake ExtendedHandshake)
+	// Called for every message of the extension sent by the peer
+	HandleMessage(p *Peer, swarm *Swarm, payload []byte) error
+}
+
+// An extension that also runs in the background while the swarm is
+// running, eg: to send messages to peers periodically
+type BackgroundExtension interface {
+	Extension
+	Start(swarm *Swarm)
+	Stop()
+}
+
+// The registered extensions, the ID we assign each extension is its
+// position in the registry starting at 1, as 0 is the extended handshake
+type ExtensionRegistry struct {
+	mu			*sync.Mutex
+	extensions	[]Extension
+}
+
+// The extended handshake dictionary sent by a peer or by us
+type ExtendedHandshake struct {
+	Extensions		map[string]int // `m`: message ID of each extension
+	Version			string         // `v`: client name and version
+	ListenPort		int            // `p`: port the peer accepts connections on
+	RequestQueue	int            // `reqq`: outstanding requests the peer accepts
+	YourIP			net.IP         // `yourip`: our IP as seen by the peer
+	MetadataSize	int            // `metadata_size`: size of the info dictionary
+}
+
+// Create an empty extension registry
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		mu: &sync.Mutex{},
+		extensions: []Extension{},
+	}
+}
+
+// Register an extension, replacing any extension with the same name
+func (r *ExtensionRegistry) Register(extension Extension) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, existing := range r.extensions {
+		if existing.Name() == extension.Name() {
+			r.extensions[i] = extension
+			return
+		}
+	}
+	r.extensions = append(r.extensions, extension)
+}
+
+// Get the IDs we assigned each registered extension, sent as `m`
+func (r *ExtensionRegistry) LocalIds() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := map[string]int{}
+	for i, extension := range r.extensions {
+		ids[extension.Name()] = i + 1
+	}
+	return ids
+}
+
+// Get the extension we assigned the provided ID
+func (r *ExtensionRegistry) Get(localId int) (Extension, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if localId < 1 || localId > len(r.extensions) {
+		return nil, false
+	}
+	return r.extensions[localId - 1], true
+}
+
+// Get all the registered extensions
+func (r *ExtensionRegistry) All() []Extension {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Extension{}, r.extensions...)
+}
+
+// Encode the extended handshake, optional fields are left out when empty
+func (h *ExtendedHandshake) Encode() ([]byte, error) {
+	extensions := map[string]interface{}{}
+	for name, id := range h.Extensions {
+		extensions[name] = id
+	}
+
+	data := map[string]interface{}{"m": extensions}
+	if h.Version != "" {
+		data["v"] = h.Version
+	}
+	if h.ListenPort > 0 {
+		data["p"] = h.ListenPort
+	}
+	if h.RequestQueue > 0 {
+		data["reqq"] = h.RequestQueue
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		data["yourip"] = string(ip4)
+	} else if h.YourIP != nil {
+		data["yourip"] = string(h.YourIP.To16())
+	}
+	if h.MetadataSize > 0 {
+		data["metadata_size"] = h.MetadataSize
+	}
+
+	var buffer bytes.Buffer
+	encodeErr := bencode.Marshal(&buffer, data)
+	return buffer.Bytes(), encodeErr
+}
+
+// Decode the extended handshake received from a peer, fields with an
+// unexpected type are ignored
+func decodeExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	handshake := ExtendedHandshake{Extensions: map[string]int{}}
+
+	data, decodeErr := utils.DecodeBencodeDict(payload)
+	if decodeErr != nil {
+		return handshake, decodeErr
+	}
+
+	extensions, ok := data["m"].(map[string]interface{})
+	if !ok {
+		return handshake, errors.New("Missing extensions in extended handshake")
+	}
+	for name, id := range extensions {
+		// An ID of 0 means the extension is disabled
+		if extendedId, ok := id.(int64); ok && extendedId > 0 && extendedId < 256 {
+			handshake.Extensions[name] = int(extendedId)
+		}
+	}
+
+	if version, ok := data["v"].(string); ok {
+		handshake.Version = version
+	}
+	if port, ok := data["p"].(int64); ok && port > 0 && port < 65536 {
+		handshake.ListenPort = int(port)
+	}
+	if requestQueue, ok := data["reqq"].(int64); ok && requestQueue > 0 {
+		handshake.RequestQueue = int(requestQueue)
+	}
+	if yourIP, ok := data["yourip"].(string); ok && (len(yourIP) == 4 || len(yourIP) == 16) {
+		handshake.YourIP = net.IP(yourIP)
+	}
+	if metadataSize, ok := data["metadata_size"].(int64); ok && metadataSize > 0 {
+		handshake.MetadataSize = int(metadataSize)
+	}
+
+	return handshake, nil
+}
+
+// Serialize an extension message with the bencoded payload, followed by
+// any raw data
+func newExtendedMessage(extendedId int, payload interface{}, data []byte) (Message, error) {
+	var buffer bytes.Buffer
+	encodeErr := bencode.Marshal(&buffer, payload)
+	if encodeErr != nil {
+		return Message{}, encodeErr
+	}
+	buffer.Write(data)
+
+	return Message{
+		PrefixLength: 2 + buffer.Len(),
+		MessageId: MSG_EXTENDED,
+		Payload: []int{},
+		ExtendedId: extendedId,
+		ExtendedPayload: buffer.Bytes(),
+	}, nil
+}
+
+// Send an extension message with the bencoded payload to the Peer using
+// the provided extension message ID
+func (p *Peer) SendExtended(extendedId int, payload interface{}) error {
+	message, messageErr := newExtendedMessage(extendedId, payload, nil)
+	if messageErr != nil {
+		return messageErr
+	}
+	return p.SendMessage(message)
+}
+
+// Send a message of the extension with the provided name to the Peer,
+// using the ID the Peer assigned it. This can be called from other
+// goroutines, so failures are left to the peer's own goroutine to handle
+func (p *Peer) SendExtension(name string, payload interface{}, data []byte) error {
+	extendedId, supported := p.ExtensionId(name)
+	if !supported {
+		return ErrExtensionNotSupported
+	}
+
+	message, messageErr := newExtendedMessage(extendedId, payload, data)
+	if messageErr != nil {
+		return messageErr
+	}
+	return p.writeMessage(message)
+}
+
+// Safely get the ID the Peer assigned the extension with the provided
+// name, returns false if the Peer does not support it
+func (p *Peer) ExtensionId(name string) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	extendedId, supported := p.Connection.Extensions.Extensions[name]
+	return extendedId, supported
+}
+
+// Send our extended handshake to the Peer
+func (p *Peer) SendExtendedHandshake(handshake ExtendedHandshake) error {
+	if ip, ok := p.remoteIP(); ok {
+		handshake.YourIP = ip
+	}
+
+	payload, encodeErr := handshake.Encode()
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return p.SendMessage(Message{
+		PrefixLength: 2 + len(payload),
+		MessageId: MSG_EXTENDED,
+		Payload: []int{},
+		ExtendedId: EXTENDED_HANDSHAKE_ID,
+		ExtendedPayload: payload,
+	})
+}
+
+// Send our extended handshake to the Peer with the extensions registered
+// in the swarm
+func (p *Peer) sendSwarmHandshake(swarm *Swarm) error {
+	return p.SendExtendedHandshake(ExtendedHandshake{
+		Extensions: swarm.Extensions.LocalIds(),
+		Version: CLIENT_VERSION,
+		ListenPort: swarm.Torrent.Port,
+		RequestQueue: DEFAULT_REQUEST_QUEUE,
+		MetadataSize: len(swarm.Torrent.RawInfo),
+	})
+}
+
+// Handle an extension message from the Peer, either its extended
+// handshake or a message routed to the extension by the ID we assigned it
+func (p *Peer) handleExtended(swarm *Swarm, message Message) error {
+	if message.ExtendedId == EXTENDED_HANDSHAKE_ID {
+		handshake, decodeErr := decodeExtendedHandshake(message.ExtendedPayload)
+		if decodeErr != nil {
+			return decodeErr
+		}
+
+		p.mu.Lock()
+		p.Connection.Extensions = handshake
+		p.mu.Unlock()
+
+		for _, extension := range swarm.Extensions.All() {
+			if _, supported := handshake.Extensions[extension.Name()]; supported {
+				extension.HandleHandshake(p, swarm, handshake)
+			}
+		}
+		return nil
+	}
+
+	extension, found := swarm.Extensions.Get(message.ExtendedId)
+	if !found {
+		// Ignore messages for extensions we never advertised
+		return nil
+	}
+	return extension.HandleMessage(p, swarm, message.ExtendedPayload)
+}
@@ -0,0 +1,178 @@
+package peers
+
+import (
+	T "github.com/yusuf-musleh/lit-torrent/torrent"
+
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Support for the fast extension (BEP 6) is advertised by a bit in the
+// reserved bytes of the handshake
+const FAST_EXTENSION_BYTE = 7
+const FAST_EXTENSION_BIT = 0x04
+
+// Number of pieces a peer may request from us while choked
+const ALLOWED_FAST_COUNT = 10
+
+// Number of pieces suggested by the peer we remember
+const MAX_SUGGESTED_PIECES = 16
+
+var ErrFastNotSupported = errors.New("Peer sent a fast extension message without supporting it")
+
+// Generate the allowed fast set of a peer with the canonical algorithm of
+// BEP 6, so every client gives the same peer the same pieces. Only IPv4
+// peers get an allowed fast set
+func generateAllowedFastSet(ip net.IP, infoHash [20]byte, pieceCount int, count int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || pieceCount == 0 {
+		return []int{}
+	}
+	count = min(count, pieceCount)
+
+	// Peers in the same /24 network get the same set
+	x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash[:]...)
+	allowed := []int{}
+	seen := map[int]bool{}
+	for len(allowed) < count {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(allowed) < count; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(pieceCount))
+			if !seen[index] {
+				seen[index] = true
+				allowed = append(allowed, index)
+			}
+		}
+	}
+	return allowed
+}
+
+// Let the Peer request the pieces of its allowed fast set while we choke
+// it, only the pieces of the set we have are sent
+func (p *Peer) sendAllowedFast(swarm *Swarm) error {
+	queue := swarm.FilePiecesQueue
+	p.Connection.AllowedFastSent = T.NewBitfield(queue.TotalPieceCount)
+
+	ip, ok := p.remoteIP()
+	if !ok {
+		return nil
+	}
+	allowed := generateAllowedFastSet(ip, swarm.Torrent.InfoHash, queue.TotalPieceCount, ALLOWED_FAST_COUNT)
+	for _, index := range allowed {
+		p.Connection.AllowedFastSent.SetPiece(index)
+		if !queue.HasPiece(index) {
+			continue
+		}
+		sendErr := p.SendMessage(Message{
+			PrefixLength: 5,
+			MessageId: MSG_ALLOWED_FAST,
+			Payload: []int{index},
+		})
+		if sendErr != nil {
+			return sendErr
+		}
+	}
+	return nil
+}
+
+// Let the Peer know we will not answer its request, only peers that
+// support the fast extension expect this
+func (p *Peer) rejectRequest(message Message) {
+	if !p.SupportsFast {
+		return
+	}
+	p.SendMessage(Message{
+		PrefixLength: 13,
+		MessageId: MSG_REJECT_REQUEST,
+		Payload: []int{message.Index, message.Begin, message.Length},
+	})
+}
+
+// Get the pieces we can request from the Peer right now: any piece it has
+// while it unchokes us, only its allowed fast pieces while it chokes us
+func (p *Peer) requestablePieces() T.Bitfield {
+	if p.Connection.State == UNCHOKED {
+		return p.Bitfield
+	}
+
+	requestable := T.NewBitfield(0)
+	if p.SupportsFast {
+		requestable = make(T.Bitfield, len(p.Bitfield))
+		for i := range requestable {
+			requestable[i] = p.Bitfield[i] & p.Connection.AllowedFast[i]
+		}
+	}
+	return requestable
+}
+
+// Check if there are pieces we can request from the Peer right now
+func (p *Peer) canRequest() bool {
+	return p.Connection.State == UNCHOKED || p.requestablePieces().Count() > 0
+}
+
+// Pop the next piece the Peer suggested that we can request from it and
+// is still in the queue, forgetting the suggestions that were tried
+func (p *Peer) popSuggestedPiece(queue *T.FilePiecesQueue, requestable T.Bitfield) (*T.FilePiece, bool) {
+	for len(p.Connection.Suggested) > 0 {
+		index := p.Connection.Suggested[0]
+		p.Connection.Suggested = p.Connection.Suggested[1:]
+		if !requestable.HasPiece(index) {
+			continue
+		}
+		if piece, found := queue.PopPieceIndex(index); found {
+			return piece, true
+		}
+	}
+	return nil, false
+}
+
+// Stop downloading the piece of a request the Peer rejected, putting it
+// back in the queue right away so it can be downloaded from other peers
+func (p *Peer) handleReject(swarm *Swarm, message Message) {
+	if !p.removeOutstanding(message.Index, message.Begin, message.Length) {
+		return
+	}
+
+	i, download := p.findDownload(message.Index)
+	if download == nil {
+		return
+	}
+	p.Connection.Downloads = append(p.Connection.Downloads[:i], p.Connection.Downloads[i+1:]...)
+	p.removePieceOutstanding(message.Index)
+	swarm.FilePiecesQueue.ReleasePiece(download.Piece)
+}
+
+// Handle a message of the fast extension from the Peer
+func (p *Peer) handleFastMessage(swarm *Swarm, message Message) error {
+	if !p.SupportsFast {
+		return ErrFastNotSupported
+	}
+
+	queue := swarm.FilePiecesQueue
+	switch message.MessageId {
+	case MSG_HAVE_ALL:
+		queue.RemoveAvailability(p.Bitfield)
+		copy(p.Bitfield, T.NewFullBitfield(queue.TotalPieceCount))
+		queue.AddAvailability(p.Bitfield)
+	case MSG_HAVE_NONE:
+		queue.RemoveAvailability(p.Bitfield)
+		clear(p.Bitfield)
+	case MSG_SUGGEST_PIECE:
+		if message.Index >= queue.TotalPieceCount {
+			return errors.New("Invalid suggested piece index")
+		}
+		if len(p.Connection.Suggested) == MAX_SUGGESTED_PIECES {
+			p.Connection.Suggested = p.Connection.Suggested[1:]
+		}
+		p.Connection.Suggested = append(p.Connection.Suggested, message.Index)
+	case MSG_ALLOWED_FAST:
+		// Pieces outside the torrent are ignored rather than rejected
+		p.Connection.AllowedFast.SetPiece(message.Index)
+	case MSG_REJECT_REQUEST:
+		p.handleReject(swarm, message)
+	}
+	return nil
+}
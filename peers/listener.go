@@ -0,0 +1,116 @@
+package peers
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/mse"
+	"github.com/yusuf-musleh/lit-torrent/utp"
+
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Time allowed for an incoming peer to send its handshake
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Accepts connections initiated by other peers and hands them to the
+// swarm of the torrent with the info hash in their handshake
+type Listener struct {
+	Port		int
+	Encryption	string // Encryption policy of incoming connections
+	UTP			*utp.Socket // Connections are accepted over uTP too when set
+	mu			*sync.Mutex
+	swarms		map[[20]byte]*Swarm
+	listener	net.Listener
+}
+
+// Create a listener for incoming peer connections on the provided port
+func NewListener(port int) *Listener {
+	return &Listener{
+		Port: port,
+		Encryption: mse.POLICY_PREFER,
+		mu: &sync.Mutex{},
+		swarms: map[[20]byte]*Swarm{},
+	}
+}
+
+// Accept incoming connections for the torrent of the swarm
+func (l *Listener) Register(swarm *Swarm) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.swarms[swarm.Torrent.InfoHash] = swarm
+}
+
+// Begin listening on the port and accepting connections in the background,
+// over uTP as well if the listener has a socket
+func (l *Listener) Start() error {
+	listener, listenErr := net.Listen("tcp", fmt.Sprintf(":%d", l.Port))
+	if listenErr != nil {
+		return listenErr
+	}
+
+	l.mu.Lock()
+	l.listener = listener
+	l.mu.Unlock()
+
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if errors.Is(acceptErr, net.ErrClosed) {
+				return
+			} else if acceptErr != nil {
+				continue
+			}
+			go l.handleConnection(conn)
+		}
+	}()
+
+	if l.UTP != nil {
+		go func() {
+			for {
+				conn, acceptErr := l.UTP.Accept()
+				if acceptErr != nil {
+					return
+				}
+				go l.handleConnection(conn)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Read the handshake of the incoming connection and hand it to the swarm
+// of the requested torrent, connections for unknown torrents are closed
+func (l *Listener) handleConnection(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	peerConn, handshake, readErr := l.acceptHandshake(conn)
+	if readErr != nil || validateHandshakeProtocol(handshake) != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var infoHash [20]byte
+	copy(infoHash[:], handshake[28:48])
+
+	l.mu.Lock()
+	swarm, found := l.swarms[infoHash]
+	l.mu.Unlock()
+	if !found {
+		conn.Close()
+		return
+	}
+
+	swarm.AddIncoming(peerConn, handshake)
+}
+
+// Stop accepting incoming connections
+func (l *Listener) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.listener != nil {
+		l.listener.Close()
+	}
+}
@@ -0,0 +1,130 @@
+package peers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message IDs from the BitTorrent protocol
+const (
+	MSG_CHOKE = iota
+	MSG_UNCHOKE
+	MSG_INTERESTED
+	MSG_NOT_INTERESTED
+	MSG_HAVE
+	MSG_BITFIELD
+	MSG_REQUEST
+	MSG_PIECE
+	MSG_CANCEL
+	MSG_PORT
+)
+
+// Message IDs from the fast extension (BEP 6)
+const (
+	MSG_SUGGEST_PIECE = iota + 13
+	MSG_HAVE_ALL
+	MSG_HAVE_NONE
+	MSG_REJECT_REQUEST
+	MSG_ALLOWED_FAST
+)
+const MSG_EXTENDED = 20
+const MSG_KEEP_ALIVE = -1
+
+// Upper bound on the length of a message we are willing to read, large
+// enough for the bitfield of a torrent with millions of pieces
+const MAX_MESSAGE_LENGTH = 1 << 21
+
+// Read the next message from the Peer: the 4 byte length prefix followed
+// by exactly that many bytes, decoding the payload based on message ID
+func ReadMessage(reader io.Reader) (Message, error) {
+	prefix := make([]byte, 4)
+	_, prefixErr := io.ReadFull(reader, prefix)
+	if prefixErr != nil {
+		return Message{}, prefixErr
+	}
+
+	prefixLength := int(binary.BigEndian.Uint32(prefix))
+	if prefixLength == 0 {
+		return Message{PrefixLength: 0, MessageId: MSG_KEEP_ALIVE}, nil
+	} else if prefixLength > MAX_MESSAGE_LENGTH {
+		return Message{}, fmt.Errorf("Message length %d exceeds maximum", prefixLength)
+	}
+
+	content := make([]byte, prefixLength)
+	_, contentErr := io.ReadFull(reader, content)
+	if contentErr != nil {
+		return Message{}, contentErr
+	}
+
+	message := Message{
+		PrefixLength: prefixLength,
+		MessageId: int(content[0]),
+		RawPayload: content[1:],
+	}
+
+	decodeErr := message.decodePayload()
+	if decodeErr != nil {
+		return Message{}, decodeErr
+	}
+
+	return message, nil
+}
+
+// Decode the raw payload into the typed fields of the message based on
+// its message ID, validating the payload length
+func (m *Message) decodePayload() error {
+	payload := m.RawPayload
+
+	switch m.MessageId {
+	case MSG_CHOKE, MSG_UNCHOKE, MSG_INTERESTED, MSG_NOT_INTERESTED, MSG_HAVE_ALL, MSG_HAVE_NONE:
+		if len(payload) != 0 {
+			return errors.New("Unexpected payload in message")
+		}
+	case MSG_HAVE, MSG_SUGGEST_PIECE, MSG_ALLOWED_FAST:
+		if len(payload) != 4 {
+			return errors.New("Invalid have/suggest/allowed fast message length")
+		}
+		m.Index = int(binary.BigEndian.Uint32(payload))
+	case MSG_BITFIELD:
+		m.Bitfield = payload
+	case MSG_REQUEST, MSG_CANCEL, MSG_REJECT_REQUEST:
+		if len(payload) != 12 {
+			return errors.New("Invalid request/cancel/reject message length")
+		}
+		m.Index = int(binary.BigEndian.Uint32(payload[0:4]))
+		m.Begin = int(binary.BigEndian.Uint32(payload[4:8]))
+		m.Length = int(binary.BigEndian.Uint32(payload[8:12]))
+	case MSG_PIECE:
+		/*
+		 * -- Example Piece message --
+		 *
+		 * Received:               [0 0 64 9 7 0 0 0 0 0 0 0 0 35 35 32 87 ...
+		 * prefixed length            |------|
+		 * message id                        ||
+		 * index                               |-----|
+		 * begin                                       |-----|
+		 * block                                               |---------- ...
+		 */
+		if len(payload) < 8 {
+			return errors.New("Invalid piece message length")
+		}
+		m.Index = int(binary.BigEndian.Uint32(payload[0:4]))
+		m.Begin = int(binary.BigEndian.Uint32(payload[4:8]))
+		m.Block = payload[8:]
+	case MSG_PORT:
+		if len(payload) != 2 {
+			return errors.New("Invalid port message length")
+		}
+		m.ListenPort = int(binary.BigEndian.Uint16(payload))
+	case MSG_EXTENDED:
+		if len(payload) < 1 {
+			return errors.New("Invalid extended message length")
+		}
+		m.ExtendedId = int(payload[0])
+		m.ExtendedPayload = payload[1:]
+	}
+
+	return nil
+}
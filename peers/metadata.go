@@ -0,0 +1,315 @@
+package peers
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+	"github.com/yusuf-musleh/lit-torrent/utp"
+
+	"crypto/sha1"
+	"errors"
+	"sync"
+	"time"
+)
+
+// The metadata (info dictionary) is exchanged in pieces of 16KiB (BEP 9)
+const METADATA_PIECE_SIZE = 16384
+const MAX_METADATA_SIZE = 16 * 1024 * 1024
+
+// Number of peers to fetch the metadata from at once, and the time
+// allowed for each of them
+const METADATA_FETCH_PEERS = 8
+const METADATA_FETCH_TIMEOUT = 30 * time.Second
+
+const UT_METADATA = "ut_metadata"
+
+// The ID we assign ut_metadata when connecting to peers only to fetch
+// the metadata
+const METADATA_FETCH_ID = 1
+
+// Message types of the ut_metadata extension
+const (
+	METADATA_REQUEST = iota
+	METADATA_DATA
+	METADATA_REJECT
+)
+
+var ErrMetadataUnavailable = errors.New("Failed to fetch metadata from peers")
+
+// The metadata being fetched from a peer, assembled from its pieces
+type metadataDownload struct {
+	Data		[]byte
+	Received	[]bool
+	Remaining	int
+}
+
+// Prepare to fetch metadata of the provided size, validating the size
+// advertised by the peer
+func newMetadataDownload(size int) (*metadataDownload, error) {
+	if size <= 0 || size > MAX_METADATA_SIZE {
+		return nil, errors.New("Invalid metadata size")
+	}
+	pieceCount := (size + METADATA_PIECE_SIZE - 1) / METADATA_PIECE_SIZE
+	return &metadataDownload{
+		Data: make([]byte, size),
+		Received: make([]bool, pieceCount),
+		Remaining: pieceCount,
+	}, nil
+}
+
+// Store a piece of the metadata, every piece must be full sized except
+// for the last one
+func (md *metadataDownload) addPiece(index int, data []byte) error {
+	if index < 0 || index >= len(md.Received) {
+		return errors.New("Invalid metadata piece index")
+	}
+
+	begin := index * METADATA_PIECE_SIZE
+	end := min(begin + METADATA_PIECE_SIZE, len(md.Data))
+	if len(data) != end - begin {
+		return errors.New("Invalid metadata piece length")
+	}
+
+	if !md.Received[index] {
+		copy(md.Data[begin:end], data)
+		md.Received[index] = true
+		md.Remaining--
+	}
+	return nil
+}
+
+// Handle a ut_metadata message from the peer, returns true once all the
+// pieces of the metadata were received
+func (md *metadataDownload) handleMessage(payload []byte) (bool, error) {
+	encoded, data, splitErr := utils.SplitBencodeValue(payload)
+	if splitErr != nil {
+		return false, splitErr
+	}
+	message, decodeErr := utils.DecodeBencodeDict(encoded)
+	if decodeErr != nil {
+		return false, decodeErr
+	}
+
+	msgType, _ := message["msg_type"].(int64)
+	piece, _ := message["piece"].(int64)
+	switch msgType {
+	case METADATA_DATA:
+		addErr := md.addPiece(int(piece), data)
+		if addErr != nil {
+			return false, addErr
+		}
+	case METADATA_REJECT:
+		return false, errors.New("Peer rejected metadata request")
+	}
+
+	return md.Remaining == 0, nil
+}
+
+// Serves the metadata to peers that don't have it yet, eg: peers that
+// joined from a magnet URI
+type MetadataExtension struct{}
+
+func (me *MetadataExtension) Name() string {
+	return UT_METADATA
+}
+
+func (me *MetadataExtension) HandleHandshake(p *Peer, swarm *Swarm, handshake ExtendedHandshake) {}
+
+// Answer the metadata requests of the peer with the requested piece, or
+// reject them if the piece does not exist
+func (me *MetadataExtension) HandleMessage(p *Peer, swarm *Swarm, payload []byte) error {
+	message, decodeErr := utils.DecodeBencodeDict(payload)
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	msgType, _ := message["msg_type"].(int64)
+	piece, _ := message["piece"].(int64)
+	if msgType != METADATA_REQUEST {
+		return nil
+	}
+
+	metadata := swarm.Torrent.RawInfo
+	begin := int(piece) * METADATA_PIECE_SIZE
+	if piece < 0 || begin >= len(metadata) {
+		reject := map[string]interface{}{
+			"msg_type": METADATA_REJECT,
+			"piece": piece,
+		}
+		return p.SendExtension(UT_METADATA, reject, nil)
+	}
+
+	end := min(begin + METADATA_PIECE_SIZE, len(metadata))
+	data := map[string]interface{}{
+		"msg_type": METADATA_DATA,
+		"piece": piece,
+		"total_size": len(metadata),
+	}
+	return p.SendExtension(UT_METADATA, data, metadata[begin:end])
+}
+
+// Connect to the peer and fetch the metadata from it using the ut_metadata
+// extension, the metadata is only returned if it matches the info hash
+func (p *Peer) fetchMetadata(
+	infoHash [20]byte,
+	peerId string,
+	encryption string,
+	utpSocket *utp.Socket,
+) ([]byte, error) {
+	conn, connErr := dialPeer(p.GetConnectAddr(), infoHash, encryption, utpSocket, METADATA_FETCH_TIMEOUT)
+	if connErr != nil {
+		return nil, connErr
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(METADATA_FETCH_TIMEOUT))
+
+	if !p.setConnection(conn) {
+		return nil, ErrMetadataUnavailable
+	}
+
+	handshakeErr := p.PerformHandshake(infoHash, peerId)
+	if handshakeErr != nil {
+		return nil, handshakeErr
+	} else if !p.SupportsExtensions {
+		return nil, errors.New("Peer does not support extensions")
+	}
+
+	sendErr := p.SendExtendedHandshake(ExtendedHandshake{
+		Extensions: map[string]int{UT_METADATA: METADATA_FETCH_ID},
+		Version: CLIENT_VERSION,
+	})
+	if sendErr != nil {
+		return nil, sendErr
+	}
+
+	var download *metadataDownload
+	for {
+		message, readErr := ReadMessage(conn)
+		if readErr != nil {
+			return nil, readErr
+		} else if message.MessageId != MSG_EXTENDED {
+			continue
+		}
+
+		switch message.ExtendedId {
+		case EXTENDED_HANDSHAKE_ID:
+			handshake, decodeErr := decodeExtendedHandshake(message.ExtendedPayload)
+			if decodeErr != nil {
+				return nil, decodeErr
+			}
+			metadataId, supported := handshake.Extensions[UT_METADATA]
+			if !supported {
+				return nil, errors.New("Peer does not support metadata exchange")
+			}
+			if download != nil {
+				continue
+			}
+
+			var downloadErr error
+			download, downloadErr = newMetadataDownload(handshake.MetadataSize)
+			if downloadErr != nil {
+				return nil, downloadErr
+			}
+
+			// Request every piece of the metadata at once, it is small
+			for i := range download.Received {
+				request := map[string]interface{}{
+					"msg_type": METADATA_REQUEST,
+					"piece": i,
+				}
+				requestErr := p.SendExtended(metadataId, request)
+				if requestErr != nil {
+					return nil, requestErr
+				}
+			}
+		case METADATA_FETCH_ID:
+			if download == nil {
+				continue
+			}
+			complete, messageErr := download.handleMessage(message.ExtendedPayload)
+			if messageErr != nil {
+				return nil, messageErr
+			} else if !complete {
+				continue
+			}
+
+			if sha1.Sum(download.Data) != infoHash {
+				return nil, errors.New("Metadata does not match the info hash")
+			}
+			return download.Data, nil
+		}
+	}
+}
+
+// Fetch the metadata (the bencoded info dictionary) of the torrent with
+// the info hash from the peers, trying several of them at once and
+// connecting with the encryption policy, over uTP too if a socket is
+// provided. Returns as soon as one of them provided valid metadata
+func FetchMetadata(
+	infoHash [20]byte,
+	peerId string,
+	peers []Peer,
+	encryption string,
+	utpSocket *utp.Socket,
+) ([]byte, error) {
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	found := make(chan []byte, 1)
+	fetched := false
+	active := []*Peer{}
+
+	// Each worker takes the next peer until the metadata was fetched
+	next := 0
+	nextPeer := func() *Peer {
+		mu.Lock()
+		defer mu.Unlock()
+		if fetched || next >= len(peers) {
+			return nil
+		}
+		peer := newActivePeer(peers[next])
+		next++
+		active = append(active, peer)
+		return peer
+	}
+
+	for i := 0; i < METADATA_FETCH_PEERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for peer := nextPeer(); peer != nil; peer = nextPeer() {
+				data, fetchErr := peer.fetchMetadata(infoHash, peerId, encryption, utpSocket)
+				if fetchErr != nil {
+					continue
+				}
+
+				// Stop fetching from the other peers
+				mu.Lock()
+				if !fetched {
+					fetched = true
+					found <- data
+					for _, other := range active {
+						other.Close()
+					}
+				}
+				mu.Unlock()
+				return
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case metadata := <-found:
+		return metadata, nil
+	case <-finished:
+		select {
+		case metadata := <-found:
+			return metadata, nil
+		default:
+			return nil, ErrMetadataUnavailable
+		}
+	}
+}
@@ -2,20 +2,32 @@ package peers
 
 import (
 	T "github.com/yusuf-musleh/lit-torrent/torrent"
-	"github.com/yusuf-musleh/lit-torrent/utils"
 
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const BITTORRENT_PROTOCOL = "BitTorrent protocol"
-const READ_BUFFER_SIZE = 1024
+const HANDSHAKE_LENGTH = 68
+
+// Time allowed for writing a message from another peer's goroutine
+const WRITE_TIMEOUT = 30 * time.Second
+
+// Time allowed between messages from the peer, which sends keep-alives
+// every 2 minutes when it has nothing else to say
+const READ_TIMEOUT = 3 * time.Minute
+
+// Time allowed for the peer to answer our block requests before the
+// pieces being downloaded from it are handed to other peers
+const REQUEST_TIMEOUT = 60 * time.Second
 
 const (
 	HANDSHAKING = iota + 1
@@ -30,6 +42,16 @@ type Message struct {
 	PrefixLength	int
 	MessageId		int
 	Payload			[]int
+	// Decoded payload fields, populated depending on the message ID
+	Index			int
+	Begin			int
+	Length			int
+	Block			[]byte
+	Bitfield		[]byte
+	ListenPort		int
+	ExtendedId		int    // Extension message ID (BEP 10)
+	ExtendedPayload	[]byte // Bencoded extension message, possibly followed by raw data
+	RawPayload		[]byte
 }
 
 // Format message to adhere to BitTorrent protocol
@@ -53,30 +75,46 @@ func (m *Message) SerializeMsg() []byte {
 	// Include the converted payload data
 	serialized = append(serialized, payload...)
 
-	return serialized
-}
-
-// Convert BitTorrent message to Message struct, excluding a
-// parsed payload
-func ParseMsg(peerMsg []byte) Message {
-	prefixLength := int(binary.BigEndian.Uint32(peerMsg[:4]))
-	messageId := -1 // keep-alive message
+	// Include any raw bytes payload (eg: a bitfield or a block)
+	serialized = append(serialized, m.Bitfield...)
+	serialized = append(serialized, m.Block...)
 
-	// Check if it's not an empty or keep-alive message
-	if len(peerMsg) > 4 {
-		messageId = int(peerMsg[4])
+	// Include the extension message ID and its payload
+	if m.MessageId == MSG_EXTENDED {
+		serialized = append(serialized, byte(m.ExtendedId))
+		serialized = append(serialized, m.ExtendedPayload...)
 	}
 
-	return Message{
-		PrefixLength: prefixLength,
-		MessageId: messageId,
-	}
+	return serialized
 }
 
 type PeerConnectionState int
 type PeerConnection struct {
-	Conn 	net.Conn
-	State	PeerConnectionState
+	Conn 			net.Conn
+	State			PeerConnectionState
+	ConnectedAt		time.Time
+
+	// Guarded by the peer's lock since the choker reads them from its
+	// own goroutine
+	AmInterested	bool // We are interested in the peer's pieces
+	AmChoking		bool // We are not letting the peer request blocks
+	PeerInterested	bool // The peer is interested in our pieces
+	Downloaded		int // Bytes of blocks received from the peer
+	Uploaded		int // Bytes of blocks sent to the peer
+	LastBlockAt		time.Time
+	Extensions		ExtendedHandshake // Extended handshake sent by the peer
+
+	AllowedFast		T.Bitfield // Pieces the peer lets us request while choked
+	AllowedFastSent	T.Bitfield // Pieces we let the peer request while choked
+	Suggested		[]int      // Pieces the peer suggested we download
+
+	Downloads		[]*pieceDownload // Pieces being downloaded from the peer
+	Outstanding		[]BlockRequest   // Block requests in flight
+	WaitingSince	time.Time        // Last time a block was requested with none in flight, or received
+	PipelineDepth	int
+	DownloadRate	float64 // Bytes per second
+	rateBytes		int
+	rateWindowStart	time.Time
 }
 
 type Peer struct {
@@ -84,6 +122,60 @@ type Peer struct {
 	IP 			string
 	Port 		int64
 	Connection	PeerConnection
+	Bitfield	T.Bitfield // Pieces the peer advertised it has
+	mu			*sync.Mutex
+	requestsMu	*sync.Mutex // Guards the requests in flight of the connection
+	closed		bool
+	ready		bool // Messages can be sent from other goroutines
+	incoming	bool // The peer connected to us, so its port is not its listening port
+
+	SupportsExtensions	bool // The peer supports the extension protocol (BEP 10)
+	SupportsFast		bool // The peer supports the fast extension (BEP 6)
+}
+
+// Create a copy of the peer that is ready to be connected to, the
+// connection can then be closed safely from other goroutines
+func newActivePeer(peer Peer) *Peer {
+	activePeer := peer
+	activePeer.Connection = PeerConnection{}
+	activePeer.mu = &sync.Mutex{}
+	activePeer.requestsMu = &sync.Mutex{}
+	activePeer.closed = false
+	return &activePeer
+}
+
+// Safely set the connection of the peer, returns false if the peer was
+// closed before the connection was established
+func (p *Peer) setConnection(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requestsMu.Lock()
+	defer p.requestsMu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.Connection = PeerConnection{
+		Conn: conn,
+		State: HANDSHAKING,
+		ConnectedAt: time.Now(),
+		AmChoking: true,
+		LastBlockAt: time.Now(),
+		Downloads: []*pieceDownload{},
+		Outstanding: []BlockRequest{},
+		rateWindowStart: time.Now(),
+	}
+	return true
+}
+
+// Safely close the connection with the peer, this unblocks any pending
+// reads so the connection terminates
+func (p *Peer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.Connection.Conn != nil {
+		p.Connection.Conn.Close()
+	}
 }
 
 // Get the IP/Port pair to connect to Peer with
@@ -102,9 +194,33 @@ func (p *Peer) GetConnection() net.Conn {
 	return p.Connection.Conn
 }
 
+// Safely write the serialized message to the Peer without handling
+// failures, so it can be used from other goroutines
+func (p *Peer) writeMessage(message Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writeMessageLocked(message)
+}
+
+// Write the serialized message to the Peer, must be called while holding
+// the peer's lock
+func (p *Peer) writeMessageLocked(message Message) error {
+	if !p.ready {
+		return errors.New("Connection with peer is not ready")
+	}
+
+	// Avoid blocking the calling goroutine on a stalled connection
+	p.GetConnection().SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	_, err := p.GetConnection().Write(message.SerializeMsg())
+	p.GetConnection().SetWriteDeadline(time.Time{})
+	return err
+}
+
 // Send the actual message bytes to Peer through the TCP connection
 func (p *Peer) SendMessageBytes(msgBytes []byte) error {
+	p.mu.Lock()
 	_, err := p.GetConnection().Write(msgBytes)
+	p.mu.Unlock()
 	if err != nil {
 		p.Disconnect()
 		return err
@@ -119,60 +235,83 @@ func (p *Peer) SendMessage(message Message) error {
 	return p.SendMessageBytes(serializedMsg)
 }
 
-// Generate, perform and validate handshake with Peer
-func (p *Peer) PerformHandshake(infoHash [20]byte, peerId string) error {
-	// Generate Handshake Message
+// Generate the handshake message for the torrent with the info hash
+func generateHandshake(infoHash [20]byte, peerId string) []byte {
 	handshakeData := []byte{}
 	handshakeData = append(handshakeData, byte(19))
-	handshakeData = append(handshakeData, []byte("BitTorrent protocol")...)
-	handshakeData = append(handshakeData, make([]byte, 8)...)
+	handshakeData = append(handshakeData, []byte(BITTORRENT_PROTOCOL)...)
+	reserved := make([]byte, 8)
+	reserved[EXTENSION_PROTOCOL_BYTE] |= EXTENSION_PROTOCOL_BIT
+	reserved[FAST_EXTENSION_BYTE] |= FAST_EXTENSION_BIT
+	handshakeData = append(handshakeData, reserved...)
 	handshakeData = append(handshakeData, infoHash[:]...)
 	handshakeData = append(handshakeData, []byte(peerId)...)
+	return handshakeData
+}
 
-	sendErr := p.SendMessageBytes(handshakeData)
-	if sendErr != nil {
-		return sendErr
-	}
-
-	// Wait and Read response from the server
-	response := make([]byte, READ_BUFFER_SIZE)
-	numBytesRecieved, readErr := p.GetConnection().Read(response)
-	if readErr != nil {
-		p.Disconnect()
-		return readErr
-	}
-
-	if numBytesRecieved < 68 {
+// Validate the protocol name in a handshake received from a peer
+func validateHandshakeProtocol(handshake []byte) error {
+	if len(handshake) != HANDSHAKE_LENGTH {
 		return errors.New("Invalid Handshake length")
-	} else if response[0] != 19 {
+	} else if handshake[0] != 19 {
 		return errors.New("Missing '19' at beginning of Handshake")
-	} else if string(response[1:20]) != BITTORRENT_PROTOCOL {
+	} else if string(handshake[1:20]) != BITTORRENT_PROTOCOL {
 		return errors.New("Missing protocol name in Handshake")
-	} else if bytes.Equal(response[28:49], infoHash[:]) {
+	}
+	return nil
+}
+
+// Validate a handshake received from the Peer and populate its PeerId
+func (p *Peer) validateHandshake(handshake []byte, infoHash [20]byte) error {
+	protocolErr := validateHandshakeProtocol(handshake)
+	if protocolErr != nil {
+		return protocolErr
+	} else if !bytes.Equal(handshake[28:48], infoHash[:]) {
 		return errors.New("Invalid InfoHash in Handshake")
 	}
 
+	p.SupportsExtensions = handshake[20 + EXTENSION_PROTOCOL_BYTE] & EXTENSION_PROTOCOL_BIT != 0
+	p.SupportsFast = handshake[20 + FAST_EXTENSION_BYTE] & FAST_EXTENSION_BIT != 0
+
 	// Convert peerIds to bytes to handle different encodings
-	peerIdRecv := []byte(string(response[48:69]))
+	peerIdRecv := handshake[48:68]
 	peerIdSent := []byte(p.PeerId)
 
-	if bytes.Equal(peerIdRecv, peerIdSent) {
+	if len(peerIdSent) > 0 && !bytes.Equal(peerIdRecv, peerIdSent) {
 		return errors.New("Invalid PeerId in Handshake")
 	}
 
 	// Populate PeerId data if it was not available before
 	if p.PeerId == "" {
-		p.PeerId = string(response[48:69])
+		p.PeerId = string(peerIdRecv)
 	}
 
 	return nil
 }
 
+// Generate, perform and validate handshake with Peer
+func (p *Peer) PerformHandshake(infoHash [20]byte, peerId string) error {
+	sendErr := p.SendMessageBytes(generateHandshake(infoHash, peerId))
+	if sendErr != nil {
+		return sendErr
+	}
+
+	// Wait and Read the full handshake response from the peer
+	response := make([]byte, HANDSHAKE_LENGTH)
+	_, readErr := io.ReadFull(p.GetConnection(), response)
+	if readErr != nil {
+		p.Disconnect()
+		return readErr
+	}
+
+	return p.validateHandshake(response, infoHash)
+}
+
 // Send a Interested message to the Peer
 func (p *Peer) Interested() {
 	interested := Message{
 		PrefixLength: 1,
-		MessageId: 2,
+		MessageId: MSG_INTERESTED,
 		Payload: []int{},
 	}
 
@@ -180,15 +319,46 @@ func (p *Peer) Interested() {
 	if err != nil {
 		p.Disconnect()
 	} else {
-		p.Connection.State = INTERESTED
+		p.setInterested(true)
 	}
 }
 
+// Send a Not Interested message to the Peer once there is nothing left
+// to download from it
+func (p *Peer) NotInterested() {
+	notInterested := Message{
+		PrefixLength: 1,
+		MessageId: MSG_NOT_INTERESTED,
+		Payload: []int{},
+	}
+
+	err := p.SendMessage(notInterested)
+	if err != nil {
+		p.Disconnect()
+	} else {
+		p.setInterested(false)
+	}
+}
+
+// Safely check whether we are interested in the peer's pieces
+func (p *Peer) isInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Connection.AmInterested
+}
+
+// Safely update whether we are interested in the peer's pieces
+func (p *Peer) setInterested(interested bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Connection.AmInterested = interested
+}
+
 // Send a Request message to the Peer
 func (p *Peer) Request(index int, begin int, blockSize int) error {
 	request := Message{
 		PrefixLength: 13,
-		MessageId: 6,
+		MessageId: MSG_REQUEST,
 		Payload: []int{index, begin, blockSize},
 	}
 
@@ -199,199 +369,286 @@ func (p *Peer) Request(index int, begin int, blockSize int) error {
 	return err
 }
 
-// Reads all the bytes associated with the Block (i.e. downloading it)
-func (p *Peer) DownloadBlock(recvMessage Message, response []byte) ([]byte, error) {
-	/*
-	 * -- Example Piece message --
-	 *
-	 * Received:               [0 0 64 9 7 0 0 0 0 0 0 0 0 35 35 32 87 ...
-	 * prefixed length            |------|
-	 * message id                        ||
-     * index                               |-----|
-     * begin                                       |-----|
-     * block                                               |---------- ...
-    */
-	blockLength := recvMessage.PrefixLength - 9
-	BLOCK_STARTING_INDEX := 13
-	block := response[BLOCK_STARTING_INDEX:]
-	blockBytes := len(block)
-	for blockBytes < blockLength {
-		response := make([]byte, READ_BUFFER_SIZE)
-		n, readErr := p.GetConnection().Read(response)
-		if readErr != nil {
-			p.Disconnect()
-			return nil, readErr
-		}
-		block = append(block, response[:n]...)
-		blockBytes += n
-	}
-	return block, nil
-}
-
 // Set the connection state when disconnect + perform any other
 // actions needed on disconnect
 func (p *Peer) Disconnect() {
 	p.Connection.State = DISCONNECTED
 }
 
-// Establish TCP connection with Peer for communication
-func (p *Peer) Connect(
-	infoHash [20]byte,
-	peerId string,
-	wg *sync.WaitGroup,
-	filePieceQueue *T.FilePiecesQueue,
-	file *os.File,
-	peerCount *utils.PeerCount,
-) {
-
-	defer wg.Done()
+// Establish TCP or uTP connection with Peer for communication, encrypted
+// depending on the swarm's encryption policy
+func (p *Peer) Connect(swarm *Swarm) {
 	connectTo := p.GetConnectAddr()
-	conn, connErr := net.Dial("tcp", connectTo)
+	conn, connErr := dialPeer(connectTo, swarm.Torrent.InfoHash, swarm.Encryption, swarm.UTP, DIAL_TIMEOUT)
 	if connErr != nil {
 		return
 	}
 	defer conn.Close()
 
-	// Increment the peer count and decrement when
-	// when the connect function terminates
-	peerCount.Increment()
-	defer peerCount.Decrement()
-
 	// Initialize Peer Connection and begin Handshaking Protocol
-	p.Connection = PeerConnection{
-		Conn: conn,
-		State: HANDSHAKING,
+	if !p.setConnection(conn) {
+		return
 	}
 
 	// Perform Handshake with Peer
-	handshakeErr := p.PerformHandshake(infoHash, peerId)
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	handshakeErr := p.PerformHandshake(swarm.Torrent.InfoHash, swarm.Torrent.PeerId)
 	if handshakeErr != nil {
 		p.Disconnect()
-	} else {
-		p.Connection.State = CONNECTED
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.run(swarm)
+}
+
+// Serve a connection the Peer initiated with us, after its handshake was
+// already read and matched to the swarm by the listener
+func (p *Peer) Accept(swarm *Swarm, conn net.Conn, handshake []byte) {
+	defer conn.Close()
+
+	if !p.setConnection(conn) {
+		return
+	}
+
+	validateErr := p.validateHandshake(handshake, swarm.Torrent.InfoHash)
+	if validateErr != nil {
+		p.Disconnect()
+		return
 	}
 
-	// Send Interested message to Peer
-	p.Interested()
+	sendErr := p.SendMessageBytes(generateHandshake(swarm.Torrent.InfoHash, swarm.Torrent.PeerId))
+	if sendErr != nil {
+		return
+	}
 
-	// Initialize required variables
-	var requestFilePiece T.FilePiece
-	var currentBlockIndex int
-	var currentBlockOffset int
+	p.run(swarm)
+}
+
+// Exchange messages with the Peer after a successful handshake, both
+// downloading pieces from it and serving the pieces we have
+func (p *Peer) run(swarm *Swarm) {
+	filePieceQueue := swarm.FilePiecesQueue
+	peerCount := swarm.PeerCount
+
+	// Increment the peer count and decrement when
+	// when the connection terminates
+	peerCount.Increment()
+	defer peerCount.Decrement()
+
+	p.Connection.State = CONNECTED
+
+	// Track the pieces the peer has, populated by bitfield and have messages
+	pieceCount := filePieceQueue.TotalPieceCount
+	p.Bitfield = T.NewBitfield(pieceCount)
+	p.Connection.AllowedFast = T.NewBitfield(pieceCount)
+	defer filePieceQueue.RemoveAvailability(p.Bitfield)
+
+	// Let the Peer know which pieces we have, pieces completed afterwards
+	// are announced with have messages
+	bitfieldErr := p.SendBitfield(filePieceQueue)
+	if bitfieldErr != nil {
+		return
+	}
+
+	// Let the Peer request a few pieces even while we choke it
+	if p.SupportsFast {
+		allowedErr := p.sendAllowedFast(swarm)
+		if allowedErr != nil {
+			return
+		}
+	}
+
+	// Negotiate the extensions registered in the swarm
+	if p.SupportsExtensions {
+		extendedErr := p.sendSwarmHandshake(swarm)
+		if extendedErr != nil {
+			return
+		}
+	}
+
+	// Send Interested message to Peer if there is anything left to download
+	if !filePieceQueue.IsComplete() {
+		p.Interested()
+	}
+
+	// Begin with the configured number of requests in flight, adapted
+	// later based on the measured download rate of the peer
+	p.Connection.PipelineDepth = swarm.PipelineDepth
 
 	// Begin listening to messages from Peer after successful Handshake
 	// and sending the Interested message
 	for (p.Connection.State != DISCONNECTED) {
-		// If connection with peer is UNCHOKED, pop the next available piece
-		// from the queue (if not already) and begin requesting it's blocks
-		if p.Connection.State == UNCHOKED && requestFilePiece.Length == 0 {
-			nextFilePiece, popErr := filePieceQueue.PopPiece()
-			if popErr != nil {
+		// If connection with peer is UNCHOKED, keep the pipeline of block
+		// requests full, popping pieces from the queue as needed. While
+		// CHOKED only the allowed fast pieces can be requested
+		if p.isInterested() && p.canRequest() {
+			fillErr := p.fillPipeline(swarm)
+			if fillErr == T.ErrNoMorePieces {
+				// Nothing left to download, only keep the connection if
+				// the Peer may still want pieces from us
+				p.NotInterested()
+				if p.Bitfield.Count() == pieceCount {
+					p.Disconnect()
+					break
+				}
+			} else if fillErr != nil {
 				p.Disconnect()
 				break
 			}
-			requestFilePiece = nextFilePiece
-			// Reset the block index/offset at the beginning of a new piece download
-			currentBlockIndex = 0
-			currentBlockOffset = 0
-
-			// Send Request message to Peer
-			reqErr := p.Request(requestFilePiece.Index, currentBlockIndex, T.BLOCK_SIZE)
-			if reqErr != nil {
-				// Reset the piece if requesting the block failed
-				requestFilePiece = requestFilePiece.Reset(filePieceQueue)
-				continue
-			}
 		}
 
-		// Read response from the server
-		response := make([]byte, READ_BUFFER_SIZE)
-		n, readErr := p.GetConnection().Read(response)
-		if readErr != nil {
+		// Give up on peers that stopped answering our requests, the
+		// pieces are released below so other peers can download them
+		if p.requestTimedOut() {
 			p.Disconnect()
-			// Reset FilePiece if it fails while being processed
-			if requestFilePiece.Length != 0 {
-				requestFilePiece = requestFilePiece.Reset(filePieceQueue)
-			}
 			break
 		}
 
-		recvMessage := ParseMsg(response[:n])
+		// Read the next complete message from the peer
+		p.GetConnection().SetReadDeadline(p.readDeadline())
+		recvMessage, readErr := ReadMessage(p.GetConnection())
+		if readErr != nil {
+			p.Disconnect()
+			break
+		}
 
-		// TODO: look into changing these to cases?
-		if recvMessage.MessageId == 0 {
+		switch recvMessage.MessageId {
+		case MSG_CHOKE:
 			p.Connection.State = CHOKED
-		} else if recvMessage.MessageId == 1 {
+			p.resetPipeline(swarm)
+		case MSG_UNCHOKE:
 			p.Connection.State = UNCHOKED
-		} else if recvMessage.MessageId == 7 {
-			// Handle receiving piece from peer
-			block, err := p.DownloadBlock(recvMessage, response)
-			if err != nil {
-				// If any block fails, assume this whole piece failed
-				// to keep it simple.
-				requestFilePiece = requestFilePiece.Reset(filePieceQueue)
+		case MSG_INTERESTED:
+			p.handleInterest(swarm, true)
+		case MSG_NOT_INTERESTED:
+			p.handleInterest(swarm, false)
+		case MSG_HAVE:
+			if recvMessage.Index >= pieceCount {
+				p.Disconnect()
+				continue
+			}
+			if !p.Bitfield.HasPiece(recvMessage.Index) {
+				p.Bitfield.SetPiece(recvMessage.Index)
+				filePieceQueue.IncrementAvailability(recvMessage.Index)
+			}
+		case MSG_BITFIELD:
+			if len(recvMessage.Bitfield) != len(p.Bitfield) {
+				p.Disconnect()
 				continue
 			}
+			filePieceQueue.RemoveAvailability(p.Bitfield)
+			copy(p.Bitfield, recvMessage.Bitfield)
+			filePieceQueue.AddAvailability(p.Bitfield)
+		case MSG_REQUEST:
+			p.handleRequest(swarm, recvMessage)
+		case MSG_PIECE:
+			p.handleBlock(swarm, recvMessage)
+		case MSG_SUGGEST_PIECE, MSG_HAVE_ALL, MSG_HAVE_NONE, MSG_REJECT_REQUEST, MSG_ALLOWED_FAST:
+			fastErr := p.handleFastMessage(swarm, recvMessage)
+			if fastErr != nil {
+				p.Disconnect()
+			}
+		case MSG_EXTENDED:
+			extendedErr := p.handleExtended(swarm, recvMessage)
+			if extendedErr != nil {
+				p.Disconnect()
+			}
+		}
+	}
 
-			// Add block data to the PieceContent of the FilePiece
-			requestFilePiece.PieceContent = append(requestFilePiece.PieceContent, block...)
-
-			// Increment block offset and index
-			currentBlockOffset += requestFilePiece.BlockSizes[currentBlockIndex]
-			currentBlockIndex += 1
-			if currentBlockIndex < len(requestFilePiece.BlockSizes) {
-				// Request the next block
-				reqErr := p.Request(
-					requestFilePiece.Index,
-					currentBlockOffset,
-					requestFilePiece.BlockSizes[currentBlockIndex],
-				)
-				if reqErr != nil {
-					// Similar to the above reset the piece if requesting the next block failed
-					requestFilePiece = requestFilePiece.Reset(filePieceQueue)
-					continue
-				}
+	// Put the pieces being processed back in the queue if the connection
+	// terminated before they were completed
+	p.releaseDownloads(swarm)
+}
 
-			} else {
-				// No more blocks remain for this piece
-				// Verify the integrity of the file piece, discard if not valid
-				if requestFilePiece.Verify() {
-					// Write downloaded Piece Content to file at the correct offset
-					_, writeErr := file.WriteAt(requestFilePiece.PieceContent, int64(requestFilePiece.FileOffset))
-					if writeErr != nil {
-						requestFilePiece = requestFilePiece.Reset(filePieceQueue)
-						continue
-					}
-					filePieceQueue.IncrementCompleted()
-					filePieceQueue.LogProgress(peerCount)
-				} else {
-					// Discard the file piece content, put it back in the queue
-					requestFilePiece = requestFilePiece.Reset(filePieceQueue)
-					continue
-				}
+// Parse peers from the compact format, where each peer is represented by
+// its IP address followed by its 2 byte big-endian port. IPv4 peers are 6
+// bytes each (BEP 23) and IPv6 peers are 18 bytes each (BEP 7)
+func ParseCompactPeers(compactPeers string, ipLength int) []Peer {
+	peers := []Peer{}
+	peerLength := ipLength + 2
 
-				// Reset the piece variable to pop the next one from the queue
-				requestFilePiece = T.FilePiece{}
-			}
+	if len(compactPeers) % peerLength != 0 {
+		fmt.Println("Compact peers list has invalid length, ignoring trailing bytes")
+	}
+
+	for i := 0; i+peerLength <= len(compactPeers); i += peerLength {
+		peerBytes := []byte(compactPeers[i:i+peerLength])
+		peer := Peer{
+			IP: net.IP(peerBytes[:ipLength]).String(),
+			Port: int64(binary.BigEndian.Uint16(peerBytes[ipLength:])),
 		}
+		peers = append(peers, peer)
 	}
+
+	return peers
 }
 
-// Parse Tracker response, extract peers information, initialize peer count
-func ParsePeersFromTracker(trackerData map[string]interface{}) ([]Peer, utils.PeerCount) {
+// Parse a list of compact peers of either address family, such as the
+// `values` returned by DHT nodes: 6 bytes each over IPv4 and 18 bytes each
+// over IPv6. Values of any other length are ignored
+func ParseCompactPeerValues(values []string) []Peer {
 	peers := []Peer{}
-	peerInterfaces, ok := trackerData["peers"].([]interface{})
+	for _, value := range values {
+		switch len(value) {
+		case net.IPv4len + 2:
+			peers = append(peers, ParseCompactPeers(value, net.IPv4len)...)
+		case net.IPv6len + 2:
+			peers = append(peers, ParseCompactPeers(value, net.IPv6len)...)
+		}
+	}
+	return peers
+}
 
-	if ok != true {
-		fmt.Println("Could not parse peers")
-		os.Exit(1)
+// Encode peers in the compact formats, returning the IPv4 peers and the
+// IPv6 peers separately. Peers with invalid IPs are skipped
+func EncodeCompactPeers(peers []Peer) (string, string) {
+	compact := []byte{}
+	compact6 := []byte{}
+	for _, peer := range peers {
+		ip := net.ParseIP(peer.IP)
+		port := binary.BigEndian.AppendUint16([]byte{}, uint16(peer.Port))
+		if ip == nil {
+			continue
+		} else if ip4 := ip.To4(); ip4 != nil {
+			compact = append(append(compact, ip4...), port...)
+		} else {
+			compact6 = append(append(compact6, ip.To16()...), port...)
+		}
 	}
+	return string(compact), string(compact6)
+}
+
+// Parse a peer address in the host:port format, eg: from a magnet URI
+func ParsePeerAddress(address string) (Peer, error) {
+	host, port, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return Peer{}, splitErr
+	}
+	portNumber, portErr := strconv.ParseUint(port, 10, 16)
+	if portErr != nil || portNumber == 0 {
+		return Peer{}, errors.New("Invalid peer port: " + port)
+	}
+	return Peer{IP: host, Port: int64(portNumber)}, nil
+}
+
+// Parse peers from the original list of dictionaries format
+func parseDictionaryPeers(peerInterfaces []interface{}) []Peer {
+	peers := []Peer{}
 
 	for _, peerInterface := range peerInterfaces {
 		peerMap, ok := peerInterface.(map[string]interface{})
 		if ok != true {
-			fmt.Println("Could not parse peer")
-			os.Exit(1)
+			fmt.Println("Could not parse peer, skipping it")
+			continue
+		}
+
+		ip, ipOk := peerMap["ip"].(string)
+		port, portOk := peerMap["port"].(int64)
+		if !ipOk || !portOk {
+			fmt.Println("Peer missing ip or port, skipping it")
+			continue
 		}
 
 		peerId, ok := peerMap["peer id"].(string)
@@ -402,16 +659,54 @@ func ParsePeersFromTracker(trackerData map[string]interface{}) ([]Peer, utils.Pe
 		// Instantiate Peer instance
 		peer := Peer{
 			PeerId: peerId,
-			IP: peerMap["ip"].(string),
-			Port: peerMap["port"].(int64),
+			IP: ip,
+			Port: port,
 		}
 		peers = append(peers, peer)
 	}
 
-	initialPeerCount := utils.PeerCount{
-		Mu: &sync.Mutex{},
-		Count: 0,
+	return peers
+}
+
+// Parse Tracker response and extract peers information.
+// The `peers` key may be either a list of dictionaries or a compact IPv4
+// string, and IPv6 peers may be provided in the compact `peers6` key
+func ParsePeersFromTracker(trackerData map[string]interface{}) []Peer {
+	peers := []Peer{}
+
+	switch peersData := trackerData["peers"].(type) {
+	case []interface{}:
+		peers = append(peers, parseDictionaryPeers(peersData)...)
+	case string:
+		peers = append(peers, ParseCompactPeers(peersData, net.IPv4len)...)
+	case nil:
+	default:
+		fmt.Println("Could not parse peers")
+	}
+
+	if peers6Data, ok := trackerData["peers6"].(string); ok {
+		peers = append(peers, ParseCompactPeers(peers6Data, net.IPv6len)...)
+	}
+
+	return peers
+}
+
+// Parse the responses from multiple trackers and merge their peers into
+// a single list without duplicates
+func ParsePeersFromTrackers(trackersData []map[string]interface{}) []Peer {
+	peers := []Peer{}
+	seen := map[string]bool{}
+
+	for _, trackerData := range trackersData {
+		trackerPeers := ParsePeersFromTracker(trackerData)
+		for _, peer := range trackerPeers {
+			connectAddr := peer.GetConnectAddr()
+			if !seen[connectAddr] {
+				seen[connectAddr] = true
+				peers = append(peers, peer)
+			}
+		}
 	}
 
-	return peers, initialPeerCount
+	return peers
 }
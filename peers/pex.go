@@ -0,0 +1,182 @@
+package peers
+
+import (
+	T "github.com/yusuf-musleh/lit-torrent/torrent"
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"net"
+	"sync"
+	"time"
+)
+
+const UT_PEX = "ut_pex"
+
+// Peer exchange messages are sent at most once a minute, with a limited
+// number of added and dropped peers each (BEP 11)
+const PEX_INTERVAL = time.Minute
+const MAX_PEX_PEERS = 50
+
+// Exchanges the peers we are connected to with the peers that support
+// ut_pex, so new peers can be found without the trackers. It must not be
+// registered for private torrents
+type PexExtension struct {
+	mu		*sync.Mutex
+	sent	map[*Peer]map[string]Peer // Peers last sent to each peer
+	stop	chan struct{}
+	stopped	chan struct{}
+}
+
+// Create the peer exchange extension
+func NewPexExtension() *PexExtension {
+	return &PexExtension{
+		mu: &sync.Mutex{},
+		sent: map[*Peer]map[string]Peer{},
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (pe *PexExtension) Name() string {
+	return UT_PEX
+}
+
+func (pe *PexExtension) HandleHandshake(p *Peer, swarm *Swarm, handshake ExtendedHandshake) {}
+
+// Add the peers the peer is connected to as candidates of the swarm, the
+// dropped peers are ignored as the swarm forgets failed peers anyway
+func (pe *PexExtension) HandleMessage(p *Peer, swarm *Swarm, payload []byte) error {
+	message, decodeErr := utils.DecodeBencodeDict(payload)
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	added := []Peer{}
+	if compact, ok := message["added"].(string); ok {
+		added = append(added, ParseCompactPeers(compact, net.IPv4len)...)
+	}
+	if compact, ok := message["added6"].(string); ok {
+		added = append(added, ParseCompactPeers(compact, net.IPv6len)...)
+	}
+	if len(added) > 2 * MAX_PEX_PEERS {
+		added = added[:2 * MAX_PEX_PEERS]
+	}
+
+	swarm.AddPeers(T.PEER_SOURCE_PEX, added)
+	return nil
+}
+
+// Begin sending the changes to our connected peers every PEX_INTERVAL
+func (pe *PexExtension) Start(swarm *Swarm) {
+	go pe.run(swarm)
+}
+
+// Stop sending peer exchange messages
+func (pe *PexExtension) Stop() {
+	close(pe.stop)
+	<-pe.stopped
+}
+
+func (pe *PexExtension) run(swarm *Swarm) {
+	defer close(pe.stopped)
+
+	ticker := time.NewTicker(PEX_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pe.sendUpdates(swarm)
+		case <-pe.stop:
+			return
+		}
+	}
+}
+
+// Encode peers into the compact format along with their flags, which we
+// leave empty
+func encodePexPeers(peers []Peer) (string, string, string, string) {
+	compact, compact6 := EncodeCompactPeers(peers)
+	flags := string(make([]byte, len(compact) / 6))
+	flags6 := string(make([]byte, len(compact6) / 18))
+	return compact, flags, compact6, flags6
+}
+
+// Send every peer that supports ut_pex the peers we connected to and
+// disconnected from since the last message it was sent
+func (pe *PexExtension) sendUpdates(swarm *Swarm) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	connectedPeers := swarm.connectedPeers()
+	connected := map[string]Peer{}
+	for _, address := range connectedPeers {
+		connected[address.GetConnectAddr()] = address
+	}
+
+	recipients := map[*Peer]bool{}
+	for _, peer := range swarm.readyPeers() {
+		if _, supported := peer.ExtensionId(UT_PEX); !supported {
+			continue
+		}
+		recipients[peer] = true
+
+		sent, known := pe.sent[peer]
+		if !known {
+			sent = map[string]Peer{}
+		}
+
+		// Never send the peer its own address
+		ownAddress := ""
+		if address, ok := connectedPeers[peer]; ok {
+			ownAddress = address.GetConnectAddr()
+		}
+
+		added := []Peer{}
+		for address, candidate := range connected {
+			if _, wasSent := sent[address]; !wasSent && address != ownAddress {
+				added = append(added, candidate)
+			}
+		}
+		dropped := []Peer{}
+		for address, candidate := range sent {
+			if _, stillConnected := connected[address]; !stillConnected {
+				dropped = append(dropped, candidate)
+			}
+		}
+
+		added = added[:min(len(added), MAX_PEX_PEERS)]
+		dropped = dropped[:min(len(dropped), MAX_PEX_PEERS)]
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		addedPeers, addedFlags, addedPeers6, addedFlags6 := encodePexPeers(added)
+		droppedPeers, droppedPeers6 := EncodeCompactPeers(dropped)
+		message := map[string]interface{}{
+			"added": addedPeers,
+			"added.f": addedFlags,
+			"added6": addedPeers6,
+			"added6.f": addedFlags6,
+			"dropped": droppedPeers,
+			"dropped6": droppedPeers6,
+		}
+		if peer.SendExtension(UT_PEX, message, nil) != nil {
+			continue
+		}
+
+		for _, candidate := range added {
+			sent[candidate.GetConnectAddr()] = candidate
+		}
+		for _, candidate := range dropped {
+			delete(sent, candidate.GetConnectAddr())
+		}
+		pe.sent[peer] = sent
+	}
+
+	// Forget the peers that disconnected
+	for peer := range pe.sent {
+		if !recipients[peer] {
+			delete(pe.sent, peer)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package peers
+
+import (
+	T "github.com/yusuf-musleh/lit-torrent/torrent"
+
+	"time"
+)
+
+const DEFAULT_PIPELINE_DEPTH = 5
+const DEFAULT_MAX_PIPELINE_DEPTH = 64
+
+// Keep enough requests in flight to cover this much time at the measured
+// download rate of the peer
+const PIPELINE_TARGET_QUEUE_TIME = 2 * time.Second
+const RATE_WINDOW = time.Second
+
+type BlockRequest struct {
+	Index	int
+	Begin	int
+	Length	int
+}
+
+// A piece being downloaded from the peer, along with the index of the
+// next block to request
+type pieceDownload struct {
+	Piece		*T.FilePiece
+	NextBlock	int
+}
+
+// Find the next block that has not been requested or downloaded yet
+// among the pieces being downloaded from the peer that we can request
+func (p *Peer) nextBlockRequest(queue *T.FilePiecesQueue, requestable T.Bitfield) (BlockRequest, bool) {
+	// Drop pieces that were completed by other peers in endgame mode
+	downloads := []*pieceDownload{}
+	for _, download := range p.Connection.Downloads {
+		if queue.IsActive(download.Piece) {
+			downloads = append(downloads, download)
+		}
+	}
+	p.Connection.Downloads = downloads
+
+	for _, download := range p.Connection.Downloads {
+		piece := download.Piece
+		if !requestable.HasPiece(piece.Index) {
+			continue
+		}
+		for download.NextBlock < len(piece.BlockSizes) {
+			blockIndex := download.NextBlock
+			download.NextBlock++
+			request := BlockRequest{
+				Index: piece.Index,
+				Begin: blockIndex * T.BLOCK_SIZE,
+				Length: piece.BlockSizes[blockIndex],
+			}
+			if queue.HasBlock(piece, blockIndex) || p.isOutstanding(request) {
+				continue
+			}
+			return request, true
+		}
+	}
+	return BlockRequest{}, false
+}
+
+// Keep requesting blocks until the number of requests in flight reaches
+// the pipeline depth, popping new pieces from the queue as needed. Returns
+// ErrNoMorePieces once there is nothing left to download from the peer
+func (p *Peer) fillPipeline(swarm *Swarm) error {
+	queue := swarm.FilePiecesQueue
+	requestable := p.requestablePieces()
+	for p.outstandingCount() < p.Connection.PipelineDepth {
+		request, ok := p.nextBlockRequest(queue, requestable)
+		if !ok {
+			// Prefer the pieces the peer suggested, eg: pieces it has cached
+			if suggestedPiece, found := p.popSuggestedPiece(queue, requestable); found {
+				p.Connection.Downloads = append(
+					p.Connection.Downloads,
+					&pieceDownload{Piece: suggestedPiece},
+				)
+				continue
+			}
+
+			nextFilePiece, popErr := queue.PopPiece(requestable)
+			if popErr == T.ErrNoMorePieces {
+				// Every remaining piece was handed out, join the download
+				// of a piece in progress with another peer
+				nextFilePiece, popErr = queue.EndgamePiece(requestable, p.isDownloading)
+			}
+			if popErr == T.ErrNoMorePieces && len(p.Connection.Downloads) == 0 {
+				return popErr
+			} else if popErr != nil {
+				// Either wait for the pieces in progress to complete, or
+				// for have messages if the peer has none of the pieces
+				return nil
+			}
+			p.Connection.Downloads = append(
+				p.Connection.Downloads,
+				&pieceDownload{Piece: nextFilePiece},
+			)
+			continue
+		}
+
+		reqErr := p.Request(request.Index, request.Begin, request.Length)
+		if reqErr != nil {
+			return reqErr
+		}
+		p.requestsMu.Lock()
+		if len(p.Connection.Outstanding) == 0 {
+			p.Connection.WaitingSince = time.Now()
+		}
+		p.Connection.Outstanding = append(p.Connection.Outstanding, request)
+		p.requestsMu.Unlock()
+	}
+	return nil
+}
+
+// Check if the peer has not sent any of the blocks we requested for
+// longer than REQUEST_TIMEOUT
+func (p *Peer) requestTimedOut() bool {
+	p.requestsMu.Lock()
+	defer p.requestsMu.Unlock()
+	return len(p.Connection.Outstanding) > 0 && time.Since(p.Connection.WaitingSince) > REQUEST_TIMEOUT
+}
+
+// Get the deadline for the next message from the peer, which comes sooner
+// while waiting for blocks we requested
+func (p *Peer) readDeadline() time.Time {
+	deadline := time.Now().Add(READ_TIMEOUT)
+	p.requestsMu.Lock()
+	defer p.requestsMu.Unlock()
+	if len(p.Connection.Outstanding) > 0 {
+		requestDeadline := p.Connection.WaitingSince.Add(REQUEST_TIMEOUT)
+		if requestDeadline.Before(deadline) {
+			deadline = requestDeadline
+		}
+	}
+	return deadline
+}
+
+// Check if the piece with the provided index is being downloaded from
+// the peer
+func (p *Peer) isDownloading(index int) bool {
+	_, download := p.findDownload(index)
+	return download != nil
+}
+
+// Safely get the number of requests in flight
+func (p *Peer) outstandingCount() int {
+	p.requestsMu.Lock()
+	defer p.requestsMu.Unlock()
+	return len(p.Connection.Outstanding)
+}
+
+// Forget the requests in flight after being choked, since the peer
+// discards them, and put the pieces back in the queue so other peers can
+// download them. With the fast extension, allowed fast pieces can still
+// be requested, so they are kept along with their requests
+func (p *Peer) resetPipeline(swarm *Swarm) {
+	allowed := func(index int) bool {
+		return p.SupportsFast && p.Connection.AllowedFast.HasPiece(index)
+	}
+
+	p.requestsMu.Lock()
+	kept := []BlockRequest{}
+	for _, request := range p.Connection.Outstanding {
+		if allowed(request.Index) {
+			kept = append(kept, request)
+		}
+	}
+	p.Connection.Outstanding = kept
+	p.requestsMu.Unlock()
+
+	downloads := []*pieceDownload{}
+	for _, download := range p.Connection.Downloads {
+		if !allowed(download.Piece.Index) {
+			swarm.FilePiecesQueue.ReleasePiece(download.Piece)
+			continue
+		}
+		download.NextBlock = 0
+		downloads = append(downloads, download)
+	}
+	p.Connection.Downloads = downloads
+}
+
+// Safely check if the block was requested and is still in flight
+func (p *Peer) isOutstanding(request BlockRequest) bool {
+	p.requestsMu.Lock()
+	defer p.requestsMu.Unlock()
+	for _, outstanding := range p.Connection.Outstanding {
+		if outstanding == request {
+			return true
+		}
+	}
+	return false
+}
+
+// Safely remove every request in flight for blocks of the piece
+func (p *Peer) removePieceOutstanding(index int) {
+	p.requestsMu.Lock()
+	defer p.requestsMu.Unlock()
+	kept := []BlockRequest{}
+	for _, request := range p.Connection.Outstanding {
+		if request.Index != index {
+			kept = append(kept, request)
+		}
+	}
+	p.Connection.Outstanding = kept
+}
+
+// Safely remove the request from the requests in flight, returns false
+// if the block was not requested
+func (p *Peer) removeOutstanding(index int, begin int, length int) bool {
+	p.requestsMu.Lock()
+	defer p.requestsMu.Unlock()
+	for i, request := range p.Connection.Outstanding {
+		if request.Index == index && request.Begin == begin && request.Length == length {
+			p.Connection.Outstanding = append(
+				p.Connection.Outstanding[:i],
+				p.Connection.Outstanding[i+1:]...,
+			)
+			return true
+		}
+	}
+	return false
+}
+
+// Find the piece being downloaded from the peer with the provided index
+func (p *Peer) findDownload(index int) (int, *pieceDownload) {
+	for i, download := range p.Connection.Downloads {
+		if download.Piece.Index == index {
+			return i, download
+		}
+	}
+	return -1, nil
+}
+
+// Measure the download rate of the peer and adapt the pipeline depth so
+// enough requests are in flight to keep the connection busy
+func (p *Peer) updateDownloadRate(swarm *Swarm, n int) {
+	p.Connection.rateBytes += n
+	elapsed := time.Since(p.Connection.rateWindowStart)
+	if elapsed < RATE_WINDOW {
+		return
+	}
+
+	p.Connection.DownloadRate = float64(p.Connection.rateBytes) / elapsed.Seconds()
+	p.Connection.rateBytes = 0
+	p.Connection.rateWindowStart = time.Now()
+
+	targetDepth := int(p.Connection.DownloadRate * PIPELINE_TARGET_QUEUE_TIME.Seconds() / T.BLOCK_SIZE)
+	// Never exceed the number of requests the peer accepts, if it told us
+	maxDepth := swarm.MaxPipelineDepth
+	if p.Connection.Extensions.RequestQueue > 0 {
+		maxDepth = min(maxDepth, p.Connection.Extensions.RequestQueue)
+	}
+	p.Connection.PipelineDepth = min(max(targetDepth, swarm.PipelineDepth), maxDepth)
+}
+
+// Store a block received from the peer in its piece by its `begin` offset,
+// and once all the blocks of the piece arrived verify and write it to disk
+func (p *Peer) handleBlock(swarm *Swarm, message Message) {
+	if p.removeOutstanding(message.Index, message.Begin, len(message.Block)) {
+		p.requestsMu.Lock()
+		p.Connection.WaitingSince = time.Now()
+		p.requestsMu.Unlock()
+	}
+
+	// Ignore blocks for pieces we are not downloading from this peer
+	i, download := p.findDownload(message.Index)
+	if download == nil {
+		return
+	}
+
+	filePieceQueue := swarm.FilePiecesQueue
+	added, completed, blockErr := filePieceQueue.AddBlock(download.Piece, message.Begin, message.Block)
+	if blockErr != nil {
+		return
+	}
+	swarm.Torrent.Stats.AddDownloaded(len(message.Block))
+	p.updateDownloadRate(swarm, len(message.Block))
+
+	// Keep track of the blocks received for the choker
+	p.mu.Lock()
+	p.Connection.Downloaded += len(message.Block)
+	p.Connection.LastBlockAt = time.Now()
+	p.mu.Unlock()
+
+	// In endgame mode the same block may be requested from other peers,
+	// cancel those requests as soon as it arrives from anyone
+	if added && filePieceQueue.InEndgame() {
+		swarm.CancelRequest(p, BlockRequest{
+			Index: message.Index,
+			Begin: message.Begin,
+			Length: len(message.Block),
+		})
+	}
+
+	if !completed {
+		return
+	}
+
+	// No more blocks remain for this piece
+	p.Connection.Downloads = append(p.Connection.Downloads[:i], p.Connection.Downloads[i+1:]...)
+	piece := download.Piece
+
+	// Verify the integrity of the file piece, discard if not valid
+	if !piece.Verify() {
+		// Discard the file piece content, put it back in the queue
+		piece.Reset(filePieceQueue)
+		return
+	}
+
+	// Write downloaded Piece Content to the file(s) at the correct offset
+	_, writeErr := swarm.Storage.WriteAt(piece.PieceContent, int64(piece.FileOffset))
+	if writeErr != nil {
+		piece.Reset(filePieceQueue)
+		return
+	}
+	filePieceQueue.IncrementCompleted(piece)
+	filePieceQueue.LogProgress(swarm.PeerCount)
+	swarm.BroadcastHave(piece.Index)
+}
+
+// Put the pieces being downloaded back in the queue when the connection
+// terminates before they were completed
+func (p *Peer) releaseDownloads(swarm *Swarm) {
+	for _, download := range p.Connection.Downloads {
+		swarm.FilePiecesQueue.ReleasePiece(download.Piece)
+	}
+	p.Connection.Downloads = []*pieceDownload{}
+	p.requestsMu.Lock()
+	p.Connection.Outstanding = []BlockRequest{}
+	p.requestsMu.Unlock()
+}
+
+// Cancel the request for the block if it is in flight, this is called
+// from other peers' goroutines when they receive the block in endgame
+func (p *Peer) cancelRequest(request BlockRequest) {
+	if !p.removeOutstanding(request.Index, request.Begin, request.Length) {
+		return
+	}
+
+	cancel := Message{
+		PrefixLength: 13,
+		MessageId: MSG_CANCEL,
+		Payload: []int{request.Index, request.Begin, request.Length},
+	}
+
+	// Write directly instead of using SendMessage, so a failure is only
+	// handled by the peer's own goroutine when its next read fails
+	p.writeMessage(cancel)
+}
@@ -0,0 +1,308 @@
+package peers
+
+import (
+	T "github.com/yusuf-musleh/lit-torrent/torrent"
+	"github.com/yusuf-musleh/lit-torrent/mse"
+	"github.com/yusuf-musleh/lit-torrent/utils"
+	"github.com/yusuf-musleh/lit-torrent/utp"
+
+	"net"
+	"strconv"
+	"sync"
+)
+
+const MAX_PEER_CONNECTIONS = 50
+
+// The set of peers we are connected to for a torrent, new peers can be
+// added at any time while the download is running
+type Swarm struct {
+	mu					*sync.Mutex
+	wg					*sync.WaitGroup
+	Torrent				*T.Torrent
+	FilePiecesQueue		*T.FilePiecesQueue
+	Storage				*T.DownloadStorage
+	PeerCount			*utils.PeerCount
+	OnPeersExhausted	func()
+	PipelineDepth		int // Minimum number of block requests in flight per peer
+	MaxPipelineDepth	int // Maximum number of block requests in flight per peer
+	Choker				*Choker
+	Extensions			*ExtensionRegistry // Extensions negotiated with peers (BEP 10)
+	Encryption			string // Encryption policy of outgoing connections
+	UTP					*utp.Socket // Peers are dialed over uTP too when set
+	active				map[string]*Peer
+	candidates			[]Peer
+	known				[]Peer // Peers known when the swarm was closed
+	started				bool
+	closed				bool
+}
+
+// Create a swarm for downloading the torrent
+func NewSwarm(
+	torrent *T.Torrent,
+	filePiecesQueue *T.FilePiecesQueue,
+	storage *T.DownloadStorage,
+) *Swarm {
+	swarm := &Swarm{
+		mu: &sync.Mutex{},
+		wg: &sync.WaitGroup{},
+		Torrent: torrent,
+		FilePiecesQueue: filePiecesQueue,
+		Storage: storage,
+		PeerCount: &utils.PeerCount{
+			Mu: &sync.Mutex{},
+			Count: 0,
+		},
+		PipelineDepth: DEFAULT_PIPELINE_DEPTH,
+		MaxPipelineDepth: DEFAULT_MAX_PIPELINE_DEPTH,
+		Encryption: mse.POLICY_PREFER,
+		active: map[string]*Peer{},
+		candidates: []Peer{},
+	}
+	swarm.Choker = NewChoker(swarm)
+	swarm.Extensions = NewExtensionRegistry()
+	swarm.Extensions.Register(&MetadataExtension{})
+	if torrent.AllowsPeerSource(T.PEER_SOURCE_PEX) {
+		swarm.Extensions.Register(NewPexExtension())
+	}
+	return swarm
+}
+
+// Begin choking and unchoking the peers in the swarm, should be called
+// once the swarm is configured
+func (s *Swarm) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.started = true
+		s.Choker.Start()
+		for _, extension := range s.Extensions.All() {
+			if background, ok := extension.(BackgroundExtension); ok {
+				background.Start(s)
+			}
+		}
+	}
+}
+
+// Add peers discovered through the source to the swarm, connecting to them
+// right away if there is room for more connections. The peers are ignored
+// if the torrent does not allow the source
+func (s *Swarm) AddPeers(source string, peers []Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || !s.Torrent.AllowsPeerSource(source) {
+		return
+	}
+
+	known := map[string]bool{}
+	for _, candidate := range s.candidates {
+		known[candidate.GetConnectAddr()] = true
+	}
+
+	for _, peer := range peers {
+		connectAddr := peer.GetConnectAddr()
+		if _, connected := s.active[connectAddr]; connected || known[connectAddr] {
+			continue
+		}
+		known[connectAddr] = true
+		s.candidates = append(s.candidates, peer)
+	}
+
+	s.connectCandidates()
+}
+
+// Connect to the candidate peers until reaching the connection limit,
+// must be called while holding the lock
+func (s *Swarm) connectCandidates() {
+	for len(s.candidates) > 0 && len(s.active) < MAX_PEER_CONNECTIONS {
+		peer := s.candidates[0]
+		s.candidates = s.candidates[1:]
+
+		connectAddr := peer.GetConnectAddr()
+		activePeer := newActivePeer(peer)
+		s.active[connectAddr] = activePeer
+		s.wg.Add(1)
+		go s.runPeer(connectAddr, activePeer)
+	}
+}
+
+// Add a connection a peer initiated with us, after the listener read its
+// handshake. The connection is closed if there is no room for more peers
+func (s *Swarm) AddIncoming(conn net.Conn, handshake []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remoteAddr := conn.RemoteAddr().String()
+	_, connected := s.active[remoteAddr]
+	if s.closed || connected || len(s.active) >= MAX_PEER_CONNECTIONS {
+		conn.Close()
+		return
+	}
+
+	host, port, splitErr := net.SplitHostPort(remoteAddr)
+	portNumber, portErr := strconv.ParseInt(port, 10, 64)
+	if splitErr != nil || portErr != nil {
+		conn.Close()
+		return
+	}
+
+	activePeer := newActivePeer(Peer{IP: host, Port: portNumber, incoming: true})
+	s.active[remoteAddr] = activePeer
+	s.wg.Add(1)
+	go s.runIncomingPeer(remoteAddr, activePeer, conn, handshake)
+}
+
+// Serve the connection the peer initiated and remove it from the swarm
+// once the connection terminates
+func (s *Swarm) runIncomingPeer(remoteAddr string, peer *Peer, conn net.Conn, handshake []byte) {
+	defer s.wg.Done()
+	peer.Accept(s, conn, handshake)
+
+	s.mu.Lock()
+	delete(s.active, remoteAddr)
+	s.connectCandidates()
+	s.mu.Unlock()
+}
+
+// Run the connection with the peer and remove it from the swarm once
+// the connection terminates
+func (s *Swarm) runPeer(connectAddr string, peer *Peer) {
+	defer s.wg.Done()
+	peer.Connect(s)
+
+	s.mu.Lock()
+	delete(s.active, connectAddr)
+	s.connectCandidates()
+	exhausted := !s.closed && len(s.active) == 0
+	s.mu.Unlock()
+
+	// Ask for more peers if all the connections terminated before the
+	// download was complete
+	if exhausted && !s.FilePiecesQueue.IsComplete() && s.OnPeersExhausted != nil {
+		s.OnPeersExhausted()
+	}
+}
+
+// Cancel the block request in flight with every other peer in the swarm,
+// used in endgame mode once the block arrived from one of them
+func (s *Swarm) CancelRequest(from *Peer, request BlockRequest) {
+	s.mu.Lock()
+	peers := []*Peer{}
+	for _, peer := range s.active {
+		if peer != from {
+			peers = append(peers, peer)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.cancelRequest(request)
+	}
+}
+
+// Announce a newly completed piece to every peer in the swarm
+func (s *Swarm) BroadcastHave(index int) {
+	s.mu.Lock()
+	peers := []*Peer{}
+	for _, peer := range s.active {
+		peers = append(peers, peer)
+	}
+	s.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.SendHave(index)
+	}
+}
+
+// Safely get the peers in the swarm that completed the handshake
+func (s *Swarm) readyPeers() []*Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := []*Peer{}
+	for _, peer := range s.active {
+		peer.mu.Lock()
+		if peer.ready {
+			peers = append(peers, peer)
+		}
+		peer.mu.Unlock()
+	}
+	return peers
+}
+
+// Safely get the addresses the peers that completed the handshake accept
+// connections on, peers that connected to us are only included if they
+// told us their listening port
+func (s *Swarm) connectedPeers() map[*Peer]Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	connected := map[*Peer]Peer{}
+	for _, peer := range s.active {
+		peer.mu.Lock()
+		ready := peer.ready
+		listenPort := int64(peer.Connection.Extensions.ListenPort)
+		peer.mu.Unlock()
+
+		if !ready {
+			continue
+		}
+		address := Peer{IP: peer.IP, Port: peer.Port}
+		if peer.incoming && listenPort == 0 {
+			continue
+		} else if peer.incoming {
+			address.Port = listenPort
+		}
+		connected[peer] = address
+	}
+	return connected
+}
+
+// Get the peers we can connect to, ie: the peers we are connected to and
+// the candidates, must be called while holding the lock
+func (s *Swarm) knownPeers() []Peer {
+	if s.closed {
+		return s.known
+	}
+
+	peers := []Peer{}
+	for _, peer := range s.active {
+		if !peer.incoming {
+			peers = append(peers, Peer{IP: peer.IP, Port: peer.Port})
+		}
+	}
+	return append(peers, s.candidates...)
+}
+
+// Safely get the peers we can connect to in the compact IPv4 and IPv6
+// formats, eg: to save them in the resume data
+func (s *Swarm) KnownPeers() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return EncodeCompactPeers(s.knownPeers())
+}
+
+// Disconnect from all the peers in the swarm and wait for their
+// connections to terminate
+func (s *Swarm) Close() {
+	s.mu.Lock()
+	s.known = s.knownPeers()
+	s.closed = true
+	s.candidates = []Peer{}
+	for _, peer := range s.active {
+		peer.Close()
+	}
+	started := s.started
+	s.started = false
+	s.mu.Unlock()
+
+	if started {
+		s.Choker.Stop()
+		for _, extension := range s.Extensions.All() {
+			if background, ok := extension.(BackgroundExtension); ok {
+				background.Stop()
+			}
+		}
+	}
+	s.wg.Wait()
+}
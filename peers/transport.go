@@ -0,0 +1,65 @@
+package peers
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utp"
+
+	"net"
+	"time"
+)
+
+// Time allowed for a peer to accept our connection over either transport
+const DIAL_TIMEOUT = 10 * time.Second
+
+// Result of dialing a peer over one of the transports
+type dialResult struct {
+	Conn	net.Conn
+	Err		error
+}
+
+// Open a connection to the peer over TCP, and over uTP at the same time
+// when a uTP socket is provided. The first transport to connect is used,
+// the other connection is closed if it connects later
+func dialTransport(address string, utpSocket *utp.Socket, timeout time.Duration) (net.Conn, error) {
+	if utpSocket == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+
+	results := make(chan dialResult, 2)
+	go func() {
+		conn, dialErr := net.DialTimeout("tcp", address, timeout)
+		results <- dialResult{Conn: conn, Err: dialErr}
+	}()
+	go func() {
+		conn, dialErr := utpSocket.Dial(address, timeout)
+		if dialErr != nil {
+			results <- dialResult{Err: dialErr}
+			return
+		}
+		results <- dialResult{Conn: conn}
+	}()
+
+	first := <-results
+	if first.Err == nil {
+		go func() {
+			second := <-results
+			if second.Err == nil {
+				second.Conn.Close()
+			}
+		}()
+		return first.Conn, nil
+	}
+
+	second := <-results
+	return second.Conn, second.Err
+}
+
+// Get the IP address of the Peer's connection, over either transport
+func (p *Peer) remoteIP() (net.IP, bool) {
+	switch address := p.GetConnection().RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return address.IP, true
+	case *net.UDPAddr:
+		return address.IP, true
+	}
+	return nil, false
+}
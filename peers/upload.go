@@ -0,0 +1,161 @@
+package peers
+
+import (
+	T "github.com/yusuf-musleh/lit-torrent/torrent"
+)
+
+// Largest block a peer may request from us, requests for more are ignored
+const MAX_REQUEST_LENGTH = 8 * T.BLOCK_SIZE
+
+// Send a Choke message to the Peer, it can no longer request blocks
+func (p *Peer) Choke() error {
+	return p.setChoking(true)
+}
+
+// Send an Unchoke message to the Peer, it can now request blocks
+func (p *Peer) Unchoke() error {
+	return p.setChoking(false)
+}
+
+// Safely update whether we are choking the Peer, sending the Choke or
+// Unchoke message only if it changed. This is called from the choker's
+// goroutine, so failures are left to the peer's own goroutine to handle
+func (p *Peer) setChoking(choking bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Connection.AmChoking == choking {
+		return nil
+	}
+
+	messageId := MSG_UNCHOKE
+	if choking {
+		messageId = MSG_CHOKE
+	}
+	message := Message{
+		PrefixLength: 1,
+		MessageId: messageId,
+		Payload: []int{},
+	}
+
+	err := p.writeMessageLocked(message)
+	if err != nil {
+		return err
+	}
+	p.Connection.AmChoking = choking
+	return nil
+}
+
+// Safely check whether we are choking the Peer
+func (p *Peer) isChoking() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Connection.AmChoking
+}
+
+// Send a Bitfield message with the pieces we have to the Peer if we have
+// any, and from then on allow have messages to be sent to it. Holding the
+// lock ensures no completed piece is missed in between. Peers supporting
+// the fast extension are sent Have All or Have None instead when possible
+func (p *Peer) SendBitfield(queue *T.FilePiecesQueue) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bitfield := queue.GetBitfield()
+	message := Message{
+		PrefixLength: 1 + len(bitfield),
+		MessageId: MSG_BITFIELD,
+		Payload: []int{},
+		Bitfield: bitfield,
+	}
+	if p.SupportsFast && bitfield.Count() == queue.TotalPieceCount {
+		message = Message{PrefixLength: 1, MessageId: MSG_HAVE_ALL, Payload: []int{}}
+	} else if p.SupportsFast && bitfield.Count() == 0 {
+		message = Message{PrefixLength: 1, MessageId: MSG_HAVE_NONE, Payload: []int{}}
+	}
+
+	if message.MessageId != MSG_BITFIELD || bitfield.Count() > 0 {
+		_, err := p.GetConnection().Write(message.SerializeMsg())
+		if err != nil {
+			p.Disconnect()
+			return err
+		}
+	}
+
+	p.ready = true
+	return nil
+}
+
+// Send a Have message to the Peer once we completed a piece, this is
+// called from other peers' goroutines so failures are left to the
+// peer's own goroutine to handle
+func (p *Peer) SendHave(index int) error {
+	have := Message{
+		PrefixLength: 5,
+		MessageId: MSG_HAVE,
+		Payload: []int{index},
+	}
+	return p.writeMessage(have)
+}
+
+// Send a Piece message containing the requested block to the Peer
+func (p *Peer) SendPiece(index int, begin int, block []byte) error {
+	piece := Message{
+		PrefixLength: 9 + len(block),
+		MessageId: MSG_PIECE,
+		Payload: []int{index, begin},
+		Block: block,
+	}
+	return p.SendMessage(piece)
+}
+
+// Update the interest of the Peer in our pieces and let the choker
+// decide whether to unchoke or choke it
+func (p *Peer) handleInterest(swarm *Swarm, interested bool) {
+	p.mu.Lock()
+	p.Connection.PeerInterested = interested
+	p.mu.Unlock()
+
+	swarm.Choker.handleInterest(p, interested)
+}
+
+// Answer a Request message from the Peer by reading the block from the
+// downloaded file(s), requests are ignored while the Peer is choked unless
+// the piece is in its allowed fast set. Peers supporting the fast extension
+// are sent a Reject message for the requests we do not answer
+func (p *Peer) handleRequest(swarm *Swarm, message Message) {
+	if p.isChoking() && !p.Connection.AllowedFastSent.HasPiece(message.Index) {
+		p.rejectRequest(message)
+		return
+	}
+
+	queue := swarm.FilePiecesQueue
+	if message.Index >= queue.TotalPieceCount || !queue.HasPiece(message.Index) {
+		p.rejectRequest(message)
+		return
+	}
+
+	pieceOffset, pieceLength := swarm.Torrent.GetPieceBounds(message.Index)
+	if message.Length <= 0 ||
+		message.Length > MAX_REQUEST_LENGTH ||
+		message.Begin < 0 ||
+		message.Begin + message.Length > pieceLength {
+		p.rejectRequest(message)
+		return
+	}
+
+	block := make([]byte, message.Length)
+	_, readErr := swarm.Storage.ReadAt(block, int64(pieceOffset + message.Begin))
+	if readErr != nil {
+		p.rejectRequest(message)
+		return
+	}
+
+	sendErr := p.SendPiece(message.Index, message.Begin, block)
+	if sendErr == nil {
+		swarm.Torrent.Stats.AddUploaded(len(block))
+		p.mu.Lock()
+		p.Connection.Uploaded += len(block)
+		p.mu.Unlock()
+	}
+}
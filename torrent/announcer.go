@@ -0,0 +1,159 @@
+package torrent
+
+import (
+	"fmt"
+	"time"
+)
+
+const MIN_ANNOUNCE_RETRY = 15 * time.Second
+const MAX_ANNOUNCE_RETRY = 30 * time.Minute
+const STOPPED_ANNOUNCE_TIMEOUT = 10 * time.Second
+
+// Periodically re-announces to the trackers in the background, honoring
+// the `interval` and `min interval` they return, and sends the `started`,
+// `completed` and `stopped` events at the right moments
+type Announcer struct {
+	torrent		*Torrent
+	onPeers		func([]map[string]interface{})
+	needPeers	chan struct{}
+	completed	chan struct{}
+	stop		chan struct{}
+	stopped		chan struct{}
+}
+
+// Create an announcer for the torrent, the responses of every successful
+// announce are passed to onPeers so newly discovered peers can be added
+// to the running swarm
+func NewAnnouncer(t *Torrent, onPeers func([]map[string]interface{})) *Announcer {
+	return &Announcer{
+		torrent: t,
+		onPeers: onPeers,
+		needPeers: make(chan struct{}, 1),
+		completed: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Begin announcing to the trackers in the background, starting with the
+// `started` event
+func (a *Announcer) Start() {
+	go a.run()
+}
+
+// Request an early re-announce because the swarm ran out of peers, this
+// still waits for the `min interval` since the last announce
+func (a *Announcer) RequestPeers() {
+	select {
+	case a.needPeers <- struct{}{}:
+	default:
+	}
+}
+
+// Let the trackers know the download has completed
+func (a *Announcer) Completed() {
+	select {
+	case a.completed <- struct{}{}:
+	default:
+	}
+}
+
+// Stop re-announcing and let the trackers know we are leaving the swarm,
+// gives up waiting on the trackers after a short timeout
+func (a *Announcer) Stop() {
+	close(a.stop)
+	select {
+	case <-a.stopped:
+	case <-time.After(STOPPED_ANNOUNCE_TIMEOUT):
+	}
+}
+
+// Announce to the trackers with the provided event and pass on the
+// discovered peers, returns how long to wait for the next announce
+func (a *Announcer) announce(event string) (time.Duration, time.Duration, error) {
+	interval, minInterval, responses, err := a.torrent.AnnounceToTrackers(event)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if a.onPeers != nil {
+		a.onPeers(responses)
+	}
+
+	return time.Duration(interval) * time.Second, time.Duration(minInterval) * time.Second, nil
+}
+
+// Announce loop that runs until the announcer is stopped
+func (a *Announcer) run() {
+	defer close(a.stopped)
+
+	event := "started"
+	completedPending := false // Completed before `started` was delivered
+	retryDelay := MIN_ANNOUNCE_RETRY
+	var wait time.Duration
+	var minInterval time.Duration
+	var lastAnnounce time.Time
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-a.stop:
+			timer.Stop()
+			if event == "started" {
+				return
+			}
+			// Make sure a pending completion is not lost when stopping
+			// right after the download completes
+			select {
+			case <-a.completed:
+				event = "completed"
+			default:
+			}
+			if event == "completed" {
+				a.torrent.AnnounceToTrackers("completed")
+			}
+			a.torrent.AnnounceToTrackers("stopped")
+			return
+		case <-a.completed:
+			timer.Stop()
+			// The trackers have to receive `started` first, `completed` is
+			// sent right after it
+			if event == "started" {
+				completedPending = true
+			} else {
+				event = "completed"
+			}
+		case <-a.needPeers:
+			timer.Stop()
+			earliest := lastAnnounce.Add(minInterval)
+			if time.Now().Before(earliest) {
+				wait = time.Until(earliest)
+				continue
+			}
+		case <-timer.C:
+		}
+
+		nextInterval, nextMinInterval, err := a.announce(event)
+		lastAnnounce = time.Now()
+		if err != nil {
+			// Retry with backoff, keeping the event so it is not lost
+			fmt.Println("Announce failed, retrying in", retryDelay, ":", err)
+			wait = retryDelay
+			retryDelay = min(retryDelay * 2, MAX_ANNOUNCE_RETRY)
+			continue
+		}
+
+		retryDelay = MIN_ANNOUNCE_RETRY
+		minInterval = nextMinInterval
+		if event == "started" && completedPending {
+			event = "completed"
+			wait = 0
+			continue
+		}
+
+		// Never re-announce sooner than MIN_ANNOUNCE_RETRY, even if the
+		// trackers ask for it
+		event = ""
+		wait = max(nextInterval, minInterval, MIN_ANNOUNCE_RETRY)
+	}
+}
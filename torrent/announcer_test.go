@@ -0,0 +1,67 @@
+package torrent
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start an HTTP tracker on loopback recording the events it receives, it
+// answers with the interval provided
+func newEventTracker(t *testing.T, interval int) (*Torrent, func() []string) {
+	mu := &sync.Mutex{}
+	events := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali" + strconv.Itoa(interval) + "e5:peers0:e"))
+	}))
+	t.Cleanup(server.Close)
+
+	torrent := &Torrent{
+		PeerId: "-LI1000-abcdefghijkl",
+		Stats: utils.NewTransferStats(100),
+		Trackers: NewTrackerManager(server.URL + "/announce", nil),
+	}
+	return torrent, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, events...)
+	}
+}
+
+func TestAnnouncerClampsInterval(t *testing.T) {
+	torrent, events := newEventTracker(t, 0)
+	announcer := NewAnnouncer(torrent, nil)
+	announcer.Start()
+	time.Sleep(300 * time.Millisecond)
+	announcer.Stop()
+
+	// An interval of 0 does not make the announcer re-announce right away
+	got := events()
+	if len(got) != 2 || got[0] != "started" || got[1] != "stopped" {
+		t.Errorf("Expected only the started and stopped events, got %q", got)
+	}
+}
+
+func TestAnnouncerSendsStartedBeforeCompleted(t *testing.T) {
+	torrent, events := newEventTracker(t, 5)
+	announcer := NewAnnouncer(torrent, nil)
+
+	// Completing before the first announce still sends `started` first
+	announcer.Completed()
+	announcer.Start()
+	time.Sleep(300 * time.Millisecond)
+	announcer.Stop()
+
+	got := events()
+	if len(got) != 3 || got[0] != "started" || got[1] != "completed" || got[2] != "stopped" {
+		t.Errorf("Expected the started, completed and stopped events, got %q", got)
+	}
+}
@@ -0,0 +1,76 @@
+package torrent
+
+import (
+	"fmt"
+)
+
+// Tracks which pieces a peer has, each piece is represented by a single
+// bit with the high bit of the first byte corresponding to piece index 0
+type Bitfield []byte
+
+// Create an empty bitfield for a torrent with the provided piece count
+func NewBitfield(pieceCount int) Bitfield {
+	return make(Bitfield, (pieceCount + 7) / 8)
+}
+
+// Create a bitfield with every piece set, eg: for a peer that sent have_all
+func NewFullBitfield(pieceCount int) Bitfield {
+	bf := NewBitfield(pieceCount)
+	for i := 0; i < pieceCount; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+// Check if the piece with the provided index is set in the bitfield
+func (bf Bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex] >> (7 - uint(index % 8)) & 1 != 0
+}
+
+// Set the piece with the provided index in the bitfield
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - uint(index % 8))
+}
+
+// Count the number of pieces set in the bitfield
+func (bf Bitfield) Count() int {
+	count := 0
+	for _, b := range bf {
+		for ; b > 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// Describe the indices of the pieces set (or not set) in the bitfield as
+// ranges, eg: ["0-4", "7", "9-12"]
+func (bf Bitfield) Ranges(pieceCount int, set bool) []string {
+	ranges := []string{}
+	start := -1
+	for i := 0; i <= pieceCount; i++ {
+		if i < pieceCount && bf.HasPiece(i) == set {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start == -1 {
+			continue
+		} else if start == i - 1 {
+			ranges = append(ranges, fmt.Sprint(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, i - 1))
+		}
+		start = -1
+	}
+	return ranges
+}
@@ -0,0 +1,48 @@
+package torrent
+
+// Endgame mode begins once every remaining piece has been handed out to a
+// peer. From then on, a peer that runs out of pieces joins the download of
+// a piece already in progress with another peer, so a single slow peer
+// holding the last pieces cannot stall the whole download
+
+// Safely check if the download is in endgame mode
+func (queue *FilePiecesQueue) InEndgame() bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.FilePieces) == 0 && len(queue.inProgress) > 0
+}
+
+// Safely pick a piece already being downloaded by other peers that the
+// peer with the provided bitfield has and is not downloading yet, the
+// piece is shared so blocks from either peer complete it
+func (queue *FilePiecesQueue) EndgamePiece(
+	bitfield Bitfield,
+	downloading func(int) bool,
+) (*FilePiece, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if len(queue.FilePieces) > 0 {
+		return nil, ErrNoAvailablePieces
+	} else if len(queue.inProgress) == 0 {
+		return nil, ErrNoMorePieces
+	}
+
+	// Prefer the piece with the fewest blocks left so it completes soonest
+	var picked *FilePiece
+	for index, piece := range queue.inProgress {
+		if !bitfield.HasPiece(index) || downloading(index) || piece.IsComplete() {
+			continue
+		}
+		if picked == nil || piece.ReceivedCount > picked.ReceivedCount {
+			picked = piece
+		}
+	}
+
+	if picked == nil {
+		return nil, ErrNoAvailablePieces
+	}
+
+	picked.downloaders++
+	return picked, nil
+}
@@ -0,0 +1,207 @@
+package torrent
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Report this many bytes left to the trackers while the size of the
+// torrent is unknown, so they do not treat us as a seed
+const MAGNET_UNKNOWN_LEFT = BLOCK_SIZE
+
+// The `so` parameter comes from untrusted input, file indices above this
+// are rejected as are selections of more files than this
+const MAX_MAGNET_SELECT_ONLY = 1 << 16
+
+// The information provided by a magnet URI, the info dictionary itself
+// has to be fetched from peers
+type Magnet struct {
+	InfoHash	[20]byte
+	Name		string   // Display name `dn`
+	Trackers	[]string // Tracker URLs `tr`
+	Peers		[]string // Peer addresses `x.pe` in the host:port format
+	SelectOnly	[]int    // Indices of the files to download `so`
+}
+
+// Parse the info hash from the `xt` parameter, encoded either in hex or
+// in base32
+func parseMagnetInfoHash(exactTopic string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	if !strings.HasPrefix(exactTopic, "urn:btih:") {
+		return infoHash, errors.New("Unsupported magnet exact topic: " + exactTopic)
+	}
+	encoded := strings.TrimPrefix(exactTopic, "urn:btih:")
+
+	var decoded []byte
+	var decodeErr error
+	switch len(encoded) {
+	case 40:
+		decoded, decodeErr = hex.DecodeString(encoded)
+	case 32:
+		decoded, decodeErr = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, errors.New("Invalid magnet info hash length")
+	}
+	if decodeErr != nil {
+		return infoHash, errors.New("Invalid magnet info hash: " + encoded)
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// Parse the `so` parameter, a comma separated list of file indices and
+// ranges of file indices, eg: "0,2,4-6"
+func parseMagnetSelectOnly(selectOnly string) ([]int, error) {
+	indices := []int{}
+	for _, part := range strings.Split(selectOnly, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, startErr := strconv.Atoi(first)
+		end := start
+		var endErr error
+		if isRange {
+			end, endErr = strconv.Atoi(last)
+		}
+		if startErr != nil || endErr != nil || start < 0 || end < start || end >= MAX_MAGNET_SELECT_ONLY {
+			return nil, errors.New("Invalid magnet file selection: " + part)
+		}
+		if len(indices) + end - start + 1 > MAX_MAGNET_SELECT_ONLY {
+			return nil, errors.New("Too many files in magnet file selection")
+		}
+		for i := start; i <= end; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
+
+// Returns the files selected with `so` that exist in the torrent, along
+// with the indices past the last file that were ignored. No selection
+// returns nil so every file is downloaded, while a selection with none
+// of the torrent's files is an error
+func (m *Magnet) SelectedFiles(torrent *Torrent) ([]int, []int, error) {
+	if len(m.SelectOnly) == 0 {
+		return nil, nil, nil
+	}
+
+	fileCount := max(len(torrent.Info.Files), 1)
+	selected := []int{}
+	ignored := []int{}
+	for _, index := range m.SelectOnly {
+		if index < fileCount {
+			selected = append(selected, index)
+		} else {
+			ignored = append(ignored, index)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, ignored, errors.New("None of the selected files are in the torrent")
+	}
+	return selected, ignored, nil
+}
+
+// Parse a magnet URI (BEP 9), the `xt` parameter with the info hash is
+// required while the others are optional
+func ParseMagnet(uri string) (Magnet, error) {
+	magnet := Magnet{}
+
+	parsedURI, parseErr := url.Parse(uri)
+	if parseErr != nil {
+		return magnet, parseErr
+	} else if parsedURI.Scheme != "magnet" {
+		return magnet, errors.New("Not a magnet URI: " + uri)
+	}
+
+	params, queryErr := url.ParseQuery(parsedURI.RawQuery)
+	if queryErr != nil {
+		return magnet, queryErr
+	}
+
+	exactTopic := params.Get("xt")
+	if exactTopic == "" {
+		return magnet, errors.New("Missing info hash in magnet URI")
+	}
+	infoHash, hashErr := parseMagnetInfoHash(exactTopic)
+	if hashErr != nil {
+		return magnet, hashErr
+	}
+
+	magnet.InfoHash = infoHash
+	magnet.Name = params.Get("dn")
+	magnet.Trackers = params["tr"]
+	magnet.Peers = params["x.pe"]
+
+	if selectOnly := params.Get("so"); selectOnly != "" {
+		indices, selectErr := parseMagnetSelectOnly(selectOnly)
+		if selectErr != nil {
+			return magnet, selectErr
+		}
+		magnet.SelectOnly = indices
+	}
+
+	return magnet, nil
+}
+
+// Get the tiers of trackers of the magnet, each tracker in its own tier
+// so all of them are announced to
+func (m *Magnet) announceList() [][]string {
+	announceList := [][]string{}
+	for _, tracker := range m.Trackers {
+		announceList = append(announceList, []string{tracker})
+	}
+	return announceList
+}
+
+// Create a torrent from the magnet with only the information needed to
+// find peers, until its info dictionary is fetched
+func (m *Magnet) Torrent() Torrent {
+	torrent := Torrent{
+		AnnounceList: m.announceList(),
+		InfoHash: m.InfoHash,
+		Port: DEFAULT_PORT,
+		Stats: utils.NewTransferStats(MAGNET_UNKNOWN_LEFT),
+	}
+	torrent.Info.Name = m.Name
+	torrent.Trackers = NewTrackerManager("", torrent.AnnounceList)
+	torrent.GeneratePeerId()
+	return torrent
+}
+
+// Build the complete torrent from the magnet and the info dictionary
+// fetched from peers, which must match the info hash of the magnet
+func (m *Magnet) TorrentFromMetadata(rawInfo []byte, peerId string) (Torrent, error) {
+	metadata := utils.NewRawDict()
+	metadata.Set("info", rawInfo)
+
+	announceList := m.announceList()
+	if len(announceList) > 0 {
+		metadata.Set("announce", utils.EncodeBencodeString(m.Trackers[0]))
+		encodedList := []byte{'l'}
+		for _, tier := range announceList {
+			encodedList = append(encodedList, 'l')
+			encodedList = append(encodedList, utils.EncodeBencodeString(tier[0])...)
+			encodedList = append(encodedList, 'e')
+		}
+		metadata.Set("announce-list", append(encodedList, 'e'))
+	}
+
+	torrent, decodeErr := DecodeTorrent(metadata.Encode())
+	if decodeErr != nil {
+		return torrent, decodeErr
+	}
+
+	torrent.PeerId = peerId
+	torrent.GenerateInfoHashSHA1()
+	if torrent.InfoHash != m.InfoHash {
+		return torrent, errors.New("Metadata does not match the magnet info hash")
+	}
+
+	return torrent, nil
+}
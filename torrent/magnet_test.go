@@ -0,0 +1,33 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestMagnetSelectedFiles(t *testing.T) {
+	torrent := &Torrent{}
+	torrent.Info.Files = make([]fileDict, 3)
+
+	// No selection downloads every file
+	magnet := Magnet{}
+	selected, ignored, err := magnet.SelectedFiles(torrent)
+	if err != nil || selected != nil || len(ignored) != 0 {
+		t.Errorf("Expected no selection, got %v, %v, %v", selected, ignored, err)
+	}
+
+	magnet.SelectOnly = []int{0, 2, 5}
+	selected, ignored, err = magnet.SelectedFiles(torrent)
+	if err != nil || len(selected) != 2 || selected[0] != 0 || selected[1] != 2 {
+		t.Errorf("Expected files 0 and 2 to be selected, got %v, %v", selected, err)
+	}
+	if len(ignored) != 1 || ignored[0] != 5 {
+		t.Errorf("Expected file 5 to be ignored, got %v", ignored)
+	}
+
+	// A selection with none of the files is not treated as no selection
+	magnet.SelectOnly = []int{3, 4}
+	selected, ignored, err = magnet.SelectedFiles(torrent)
+	if err == nil || selected != nil || len(ignored) != 2 {
+		t.Errorf("Expected an error when no selected file exists, got %v, %v, %v", selected, ignored, err)
+	}
+}
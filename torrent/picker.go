@@ -0,0 +1,90 @@
+package torrent
+
+import (
+	"errors"
+	"math/rand"
+)
+
+const RANDOM_FIRST_PIECES = 4
+
+const (
+	PICKER_RAREST_FIRST = "rarest-first"
+	PICKER_SEQUENTIAL = "sequential"
+)
+
+// Decides which of the remaining pieces a peer downloads next
+type PiecePicker interface {
+	// Returns the position within pieces of the piece to download next
+	// from the peer with the provided bitfield, or -1 if the peer has
+	// none of them. Availability holds how many peers have each piece
+	PickPiece(pieces []FilePiece, bitfield Bitfield, availability []int, completed int) int
+}
+
+// Picks the remaining pieces in index order
+type SequentialPicker struct{}
+
+func (sp *SequentialPicker) PickPiece(
+	pieces []FilePiece,
+	bitfield Bitfield,
+	availability []int,
+	completed int,
+) int {
+	for i, piece := range pieces {
+		if bitfield.HasPiece(piece.Index) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Picks the piece that the fewest peers have, breaking ties randomly. The
+// first few pieces are picked at random instead so we quickly have complete
+// pieces to share, as rare pieces are slower to download
+type RarestFirstPicker struct {
+	RandomFirstCount	int
+}
+
+func (rp *RarestFirstPicker) PickPiece(
+	pieces []FilePiece,
+	bitfield Bitfield,
+	availability []int,
+	completed int,
+) int {
+	candidates := []int{}
+	rarest := -1
+
+	for i, piece := range pieces {
+		if !bitfield.HasPiece(piece.Index) {
+			continue
+		}
+
+		if completed < rp.RandomFirstCount {
+			candidates = append(candidates, i)
+			continue
+		}
+
+		pieceAvailability := availability[piece.Index]
+		if rarest == -1 || pieceAvailability < rarest {
+			rarest = pieceAvailability
+			candidates = []int{i}
+		} else if pieceAvailability == rarest {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return -1
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// Create the piece picker for the provided mode
+func NewPiecePicker(mode string) (PiecePicker, error) {
+	switch mode {
+	case PICKER_RAREST_FIRST:
+		return &RarestFirstPicker{RandomFirstCount: RANDOM_FIRST_PIECES}, nil
+	case PICKER_SEQUENTIAL:
+		return &SequentialPicker{}, nil
+	}
+	return nil, errors.New("Unknown piece picker: " + mode)
+}
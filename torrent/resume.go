@@ -0,0 +1,197 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const RESUME_FILE_EXTENSION = ".resume"
+const RESUME_SAVE_INTERVAL = 30 * time.Second
+
+// Size and modification time of a downloaded file when the resume data
+// was saved, used to detect changes made to it since
+type ResumeFileInfo struct {
+	Length	int64 `bencode:"length"`
+	Mtime	int64 `bencode:"mtime"` // Nanoseconds since the Unix epoch
+}
+
+// Fast-resume state of a download, saved next to the downloaded file(s)
+// so the completed pieces don't need to be rechecked on restart
+type ResumeData struct {
+	InfoHash	string           `bencode:"info-hash"`
+	Pieces		string           `bencode:"pieces"` // Bitfield of the completed pieces
+	Files		[]ResumeFileInfo `bencode:"files"`
+	Uploaded	int64            `bencode:"uploaded"`
+	Downloaded	int64            `bencode:"downloaded"`
+	Peers		string           `bencode:"peers"`  // Compact IPv4 peers
+	Peers6		string           `bencode:"peers6"` // Compact IPv6 peers
+}
+
+// Path of the resume file, next to the downloaded file or directory
+func (t *Torrent) ResumeFilePath() string {
+	return t.Info.Name + RESUME_FILE_EXTENSION
+}
+
+// Get the current size and modification time of the downloaded file(s)
+func (t *Torrent) getResumeFileInfo() ([]ResumeFileInfo, error) {
+	downloadFiles, layoutErr := t.GetDownloadFiles()
+	if layoutErr != nil {
+		return nil, layoutErr
+	}
+
+	files := []ResumeFileInfo{}
+	for _, downloadFile := range downloadFiles {
+		info, statErr := os.Stat(downloadFile.Path)
+		if statErr != nil {
+			return nil, statErr
+		}
+		files = append(files, ResumeFileInfo{
+			Length: info.Size(),
+			Mtime: info.ModTime().UnixNano(),
+		})
+	}
+	return files, nil
+}
+
+// Read the resume file of the torrent, returns an error if it is missing
+// or belongs to a different torrent
+func (t *Torrent) LoadResumeData() (ResumeData, error) {
+	data, readErr := os.ReadFile(t.ResumeFilePath())
+	if readErr != nil {
+		return ResumeData{}, readErr
+	}
+
+	resume := ResumeData{}
+	decodeErr := bencode.Unmarshal(bytes.NewReader(data), &resume)
+	if decodeErr != nil {
+		return ResumeData{}, decodeErr
+	}
+
+	if resume.InfoHash != string(t.InfoHash[:]) {
+		return ResumeData{}, errors.New("Resume file belongs to a different torrent")
+	} else if len(resume.Pieces) != len(NewBitfield(len(t.Info.Pieces) / 20)) {
+		return ResumeData{}, errors.New("Resume file has an invalid bitfield")
+	}
+
+	return resume, nil
+}
+
+// Check if the downloaded file(s) are unchanged since the resume data was
+// saved, only then its completed pieces can be trusted without a recheck
+func (t *Torrent) ResumeDataMatches(resume ResumeData) bool {
+	files, statErr := t.getResumeFileInfo()
+	if statErr != nil || len(files) != len(resume.Files) {
+		return false
+	}
+
+	for i, file := range files {
+		if file != resume.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Write the resume data of the download, replacing the previous resume
+// file only once the new one was written completely
+func (t *Torrent) SaveResumeData(queue *FilePiecesQueue, peers string, peers6 string) error {
+	// Take the bitfield before looking at the files, so a piece written in
+	// between changes the modification time and triggers a recheck rather
+	// than being trusted
+	bitfield := queue.GetBitfield()
+	files, statErr := t.getResumeFileInfo()
+	if statErr != nil {
+		return statErr
+	}
+
+	uploaded, downloaded, _ := t.Stats.Get()
+	resume := ResumeData{
+		InfoHash: string(t.InfoHash[:]),
+		Pieces: string(bitfield),
+		Files: files,
+		Uploaded: uploaded,
+		Downloaded: downloaded,
+		Peers: peers,
+		Peers6: peers6,
+	}
+
+	var buffer bytes.Buffer
+	encodeErr := bencode.Marshal(&buffer, resume)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	resumePath := t.ResumeFilePath()
+	writeErr := os.WriteFile(resumePath + ".tmp", buffer.Bytes(), 0644)
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(resumePath + ".tmp", resumePath)
+}
+
+// Periodically saves the resume data of a download in the background, and
+// once more when stopped
+type ResumeSaver struct {
+	torrent		*Torrent
+	queue		*FilePiecesQueue
+	getPeers	func() (string, string)
+	stop		chan struct{}
+	stopped		chan struct{}
+}
+
+// Create a resume saver for the download, getPeers returns the known
+// peers in the compact IPv4 and IPv6 formats
+func NewResumeSaver(
+	t *Torrent,
+	queue *FilePiecesQueue,
+	getPeers func() (string, string),
+) *ResumeSaver {
+	return &ResumeSaver{
+		torrent: t,
+		queue: queue,
+		getPeers: getPeers,
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Begin saving the resume data every RESUME_SAVE_INTERVAL
+func (rs *ResumeSaver) Start() {
+	go rs.run()
+}
+
+// Stop saving periodically and save the final state of the download
+func (rs *ResumeSaver) Stop() {
+	close(rs.stop)
+	<-rs.stopped
+	rs.save()
+}
+
+func (rs *ResumeSaver) save() {
+	peers, peers6 := rs.getPeers()
+	saveErr := rs.torrent.SaveResumeData(rs.queue, peers, peers6)
+	if saveErr != nil {
+		fmt.Println("Failed to save resume data:", saveErr)
+	}
+}
+
+func (rs *ResumeSaver) run() {
+	defer close(rs.stopped)
+
+	ticker := time.NewTicker(RESUME_SAVE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rs.save()
+		case <-rs.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package torrent
+
+import (
+	"github.com/yusuf-musleh/lit-torrent/utils"
+
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time allowed for a tracker to answer a scrape request, over either
+// protocol
+const SCRAPE_TIMEOUT = 15 * time.Second
+
+var ErrScrapeUnsupported = errors.New("Tracker does not support scrape")
+
+// The scrape result of a tracker for the torrent
+type TrackerScrape struct {
+	Tracker	string
+	Result	ScrapeResult
+	Err		error
+}
+
+// Get the scrape URL of an HTTP tracker from its announce URL, by replacing
+// `announce` at the start of the last path component with `scrape`. Trackers
+// whose announce URL does not follow this convention do not support scrape
+func ScrapeURL(announceURL string) (string, error) {
+	trackerURL, urlErr := url.Parse(announceURL)
+	if urlErr != nil {
+		return "", urlErr
+	}
+
+	slash := strings.LastIndex(trackerURL.Path, "/")
+	lastComponent := trackerURL.Path[slash+1:]
+	if !strings.HasPrefix(lastComponent, "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	trackerURL.Path = trackerURL.Path[:slash+1] + "scrape" + strings.TrimPrefix(lastComponent, "announce")
+	trackerURL.RawPath = ""
+	return trackerURL.String(), nil
+}
+
+// Performs the scrape request to an HTTP tracker, info hashes missing from
+// the response have an empty result
+func scrapeHTTP(announceURL string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	scrapeURL, scrapeErr := ScrapeURL(announceURL)
+	if scrapeErr != nil {
+		return nil, scrapeErr
+	}
+
+	queryParams := url.Values{}
+	for _, infoHash := range infoHashes {
+		queryParams.Add("info_hash", string(infoHash[:]))
+	}
+
+	// Some trackers already include query params (eg: a passkey)
+	separator := "?"
+	if strings.Contains(scrapeURL, "?") {
+		separator = "&"
+	}
+
+	client := &http.Client{Timeout: SCRAPE_TIMEOUT}
+	response, err := client.Get(scrapeURL + separator + queryParams.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, parseErr := utils.ParseBencodeResponse(response.Body)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if failReason, scrapeFailed := data["failure reason"]; scrapeFailed {
+		return nil, fmt.Errorf("%v", failReason)
+	}
+
+	files, ok := data["files"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Missing files in scrape response")
+	}
+
+	results := []ScrapeResult{}
+	for _, infoHash := range infoHashes {
+		result := ScrapeResult{}
+		if file, ok := files[string(infoHash[:])].(map[string]interface{}); ok {
+			complete, _ := file["complete"].(int64)
+			downloaded, _ := file["downloaded"].(int64)
+			incomplete, _ := file["incomplete"].(int64)
+			result = ScrapeResult{
+				Complete: int(complete),
+				Downloaded: int(downloaded),
+				Incomplete: int(incomplete),
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Performs the scrape request for the info hashes to the tracker at the
+// provided announce URL, selecting the tracker protocol based on the URL
+// scheme. Returns a result for each info hash in the same order
+func Scrape(announceURL string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	trackerURL, urlErr := url.Parse(announceURL)
+	if urlErr != nil {
+		return nil, urlErr
+	}
+
+	switch trackerURL.Scheme {
+	case "http", "https":
+		return scrapeHTTP(announceURL, infoHashes)
+	case "udp":
+		return GetUDPTracker(trackerURL.Host).Scrape(infoHashes, SCRAPE_TIMEOUT)
+	}
+	return nil, errors.New("Unsupported tracker protocol: " + trackerURL.Scheme)
+}
+
+// Scrape every tracker of the torrent in parallel, returning the results in
+// the order of the tiers
+func (t *Torrent) ScrapeTrackers() []TrackerScrape {
+	scrapes := []TrackerScrape{}
+	for _, tracker := range t.Trackers.All() {
+		scrapes = append(scrapes, TrackerScrape{Tracker: tracker})
+	}
+
+	var wg sync.WaitGroup
+	for i := range scrapes {
+		wg.Add(1)
+		go func(scrape *TrackerScrape) {
+			defer wg.Done()
+			results, err := Scrape(scrape.Tracker, [][20]byte{t.InfoHash})
+			if err != nil {
+				scrape.Err = err
+				return
+			}
+			scrape.Result = results[0]
+		}(&scrapes[i])
+	}
+	wg.Wait()
+
+	return scrapes
+}
@@ -0,0 +1,286 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// A single file on disk that is part of the torrent's content
+type DownloadFile struct {
+	Path	string
+	Length	int
+	Offset	int // Offset of the file within the torrent's contiguous data
+	File	*os.File
+}
+
+// A contiguous section of a single file that part of a piece maps to
+type FileSegment struct {
+	FileIndex	int
+	FileOffset	int
+	Length		int
+}
+
+// Maps the torrent's contiguous piece data onto the file(s) on disk,
+// pieces may span across the boundaries of multiple files
+type DownloadStorage struct {
+	Files	[]DownloadFile
+}
+
+// Validate a path segment from the .torrent file so it cannot escape
+// the download directory
+func validatePathSegment(segment string) error {
+	if segment == "" || segment == "." || segment == ".." {
+		return errors.New("Invalid path segment: '" + segment + "'")
+	}
+	if strings.ContainsAny(segment, "/\\") {
+		return errors.New("Path segment contains separator: '" + segment + "'")
+	}
+	return nil
+}
+
+// Returns the layout of the file(s) described by the torrent along with
+// their offsets within the torrent's contiguous data. Files of multi-file
+// torrents are placed in a directory under the torrent's name
+func (t *Torrent) GetDownloadFiles() ([]DownloadFile, error) {
+	nameErr := validatePathSegment(t.Info.Name)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+
+	if !t.IsMultiFile() {
+		downloadFile := DownloadFile{
+			Path: t.Info.Name,
+			Length: t.Info.Length,
+			Offset: 0,
+		}
+		return []DownloadFile{downloadFile}, nil
+	}
+
+	downloadFiles := []DownloadFile{}
+	offset := 0
+	for _, file := range t.Info.Files {
+		if len(file.Path) == 0 {
+			return nil, errors.New("Missing path for file in torrent")
+		}
+
+		pathSegments := []string{t.Info.Name}
+		for _, segment := range file.Path {
+			segmentErr := validatePathSegment(segment)
+			if segmentErr != nil {
+				return nil, segmentErr
+			}
+			pathSegments = append(pathSegments, segment)
+		}
+
+		downloadFile := DownloadFile{
+			Path: filepath.Join(pathSegments...),
+			Length: file.Length,
+			Offset: offset,
+		}
+		downloadFiles = append(downloadFiles, downloadFile)
+		offset += file.Length
+	}
+
+	return downloadFiles, nil
+}
+
+// Returns the bitfield of the pieces that contain data of the files with
+// the provided indices
+func (t *Torrent) GetFilesBitfield(fileIndices []int) (Bitfield, error) {
+	downloadFiles, layoutErr := t.GetDownloadFiles()
+	if layoutErr != nil {
+		return nil, layoutErr
+	}
+
+	bitfield := NewBitfield(len(t.Info.Pieces) / 20)
+	for _, fileIndex := range fileIndices {
+		if fileIndex < 0 || fileIndex >= len(downloadFiles) {
+			return nil, fmt.Errorf("No file with index %d in torrent", fileIndex)
+		}
+
+		file := downloadFiles[fileIndex]
+		if file.Length == 0 {
+			continue
+		}
+		firstPiece := file.Offset / t.Info.PieceLength
+		lastPiece := (file.Offset + file.Length - 1) / t.Info.PieceLength
+		for i := firstPiece; i <= lastPiece; i++ {
+			bitfield.SetPiece(i)
+		}
+	}
+	return bitfield, nil
+}
+
+// Returns the file segments that the data at the provided offset within
+// the torrent's contiguous data, with the provided length, maps to
+func (s *DownloadStorage) GetFileSegments(offset int, length int) []FileSegment {
+	segments := []FileSegment{}
+	end := offset + length
+
+	for i, file := range s.Files {
+		fileEnd := file.Offset + file.Length
+		if file.Length == 0 || fileEnd <= offset {
+			continue
+		}
+		if file.Offset >= end {
+			break
+		}
+
+		segmentStart := max(offset, file.Offset)
+		segmentEnd := min(end, fileEnd)
+		segments = append(segments, FileSegment{
+			FileIndex: i,
+			FileOffset: segmentStart - file.Offset,
+			Length: segmentEnd - segmentStart,
+		})
+	}
+
+	return segments
+}
+
+// Write data at the provided offset within the torrent's contiguous data,
+// splitting it across multiple files if needed
+func (s *DownloadStorage) WriteAt(data []byte, offset int64) (int, error) {
+	written := 0
+	for _, segment := range s.GetFileSegments(int(offset), len(data)) {
+		file := s.Files[segment.FileIndex].File
+		n, err := file.WriteAt(
+			data[written:written+segment.Length],
+			int64(segment.FileOffset),
+		)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if written < len(data) {
+		return written, errors.New("Data written beyond end of torrent")
+	}
+
+	return written, nil
+}
+
+// Read data at the provided offset within the torrent's contiguous data,
+// reading it across multiple files if needed
+func (s *DownloadStorage) ReadAt(data []byte, offset int64) (int, error) {
+	read := 0
+	for _, segment := range s.GetFileSegments(int(offset), len(data)) {
+		file := s.Files[segment.FileIndex].File
+		n, err := file.ReadAt(
+			data[read:read+segment.Length],
+			int64(segment.FileOffset),
+		)
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+
+	if read < len(data) {
+		return read, errors.New("Data read beyond end of torrent")
+	}
+
+	return read, nil
+}
+
+// Open the existing file(s) of the torrent for reading, without creating
+// or truncating them, each file must have the expected length
+func (t *Torrent) OpenDownloadStorage() (DownloadStorage, error) {
+	downloadFiles, layoutErr := t.GetDownloadFiles()
+	if layoutErr != nil {
+		return DownloadStorage{}, layoutErr
+	}
+
+	storage := DownloadStorage{Files: downloadFiles}
+	for i := range storage.Files {
+		downloadFile := &storage.Files[i]
+
+		file, fileErr := os.Open(downloadFile.Path)
+		if fileErr != nil {
+			storage.Close()
+			return DownloadStorage{}, fileErr
+		}
+		downloadFile.File = file
+
+		info, statErr := file.Stat()
+		if statErr != nil {
+			storage.Close()
+			return DownloadStorage{}, statErr
+		} else if info.Size() != int64(downloadFile.Length) {
+			storage.Close()
+			return DownloadStorage{}, errors.New("Unexpected file size: " + downloadFile.Path)
+		}
+	}
+
+	return storage, nil
+}
+
+// Check if any of the file(s) of the torrent already exist with data in
+// them, eg: from an interrupted download
+func (t *Torrent) DownloadExists() bool {
+	downloadFiles, layoutErr := t.GetDownloadFiles()
+	if layoutErr != nil {
+		return false
+	}
+
+	for _, downloadFile := range downloadFiles {
+		info, statErr := os.Stat(downloadFile.Path)
+		if statErr == nil && info.Mode().IsRegular() && info.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Read each piece from the storage and check it against its hash, using
+// a worker per CPU to hash pieces in parallel. Returns the bitfield of the
+// pieces that are valid
+func (t *Torrent) VerifyPieces(filePieces []FilePiece, storage *DownloadStorage) Bitfield {
+	verified := NewBitfield(len(filePieces))
+
+	pieces := make(chan FilePiece)
+	valid := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for piece := range pieces {
+				piece.PieceContent = make([]byte, piece.Length)
+				_, readErr := storage.ReadAt(piece.PieceContent, int64(piece.FileOffset))
+				if readErr == nil && piece.Verify() {
+					valid <- piece.Index
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, piece := range filePieces {
+			pieces <- piece
+		}
+		close(pieces)
+		wg.Wait()
+		close(valid)
+	}()
+
+	for index := range valid {
+		verified.SetPiece(index)
+	}
+	return verified
+}
+
+// Close all the files in the storage
+func (s *DownloadStorage) Close() {
+	for _, file := range s.Files {
+		if file.File != nil {
+			file.File.Close()
+		}
+	}
+}
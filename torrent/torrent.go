@@ -9,7 +9,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"errors"
 	"time"
@@ -19,6 +21,11 @@ import (
 
 const BLOCK_SIZE = 16384 // 16kiB
 const TIME_FORMAT = "2006-01-02 15:04:05"
+const DEFAULT_PORT = 6889
+
+// Time allowed for an HTTP tracker to answer an announce, after which the
+// next tracker in its tier is tried
+const HTTP_ANNOUNCE_TIMEOUT = 30 * time.Second
 
 type FilePiece struct {
 	Index			int
@@ -27,6 +34,9 @@ type FilePiece struct {
 	FileOffset		int
 	BlockSizes		[]int
 	PieceContent	[]byte
+	BlocksReceived	[]bool
+	ReceivedCount	int
+	downloaders		int // Number of peers downloading the piece
 }
 
 // Returns the sizes of the blocks that need to be downloaded
@@ -47,6 +57,43 @@ func (fp *FilePiece) ComputeBlockSizes() {
 	fp.BlockSizes = blockSizes
 }
 
+// Add a downloaded block to the piece content at the offset it belongs
+// to, so blocks can arrive in any order
+func (fp *FilePiece) AddBlock(begin int, block []byte) error {
+	blockIndex := begin / BLOCK_SIZE
+	if begin < 0 || begin % BLOCK_SIZE != 0 || blockIndex >= len(fp.BlockSizes) {
+		return errors.New("Invalid block offset")
+	} else if len(block) != fp.BlockSizes[blockIndex] {
+		return errors.New("Invalid block length")
+	}
+
+	// Allocate the full piece content when the first block arrives
+	if len(fp.PieceContent) != fp.Length {
+		fp.PieceContent = make([]byte, fp.Length)
+		fp.BlocksReceived = make([]bool, len(fp.BlockSizes))
+		fp.ReceivedCount = 0
+	}
+
+	if fp.BlocksReceived[blockIndex] {
+		return nil
+	}
+
+	copy(fp.PieceContent[begin:], block)
+	fp.BlocksReceived[blockIndex] = true
+	fp.ReceivedCount += 1
+	return nil
+}
+
+// Check if the block with the provided index was already downloaded
+func (fp *FilePiece) HasBlock(blockIndex int) bool {
+	return blockIndex < len(fp.BlocksReceived) && fp.BlocksReceived[blockIndex]
+}
+
+// Check if all the blocks of the piece were downloaded
+func (fp *FilePiece) IsComplete() bool {
+	return len(fp.BlockSizes) > 0 && fp.ReceivedCount == len(fp.BlockSizes)
+}
+
 // Verify the integrity of the content of the downloaded piece
 // by comparing the SHA1 hash
 func (fp *FilePiece) Verify() bool {
@@ -56,10 +103,10 @@ func (fp *FilePiece) Verify() bool {
 
 // Clear the piece content and put it back in the piece queue
 // so it can be processed again
-func (fp *FilePiece) Reset(queue *FilePiecesQueue) FilePiece {
-	fp.PieceContent = []byte{}
-	queue.InsertPiece(*fp)
-	return FilePiece{}
+func (fp *FilePiece) Reset(queue *FilePiecesQueue) {
+	queue.mu.Lock()
+	queue.resetPiece(fp)
+	queue.mu.Unlock()
 }
 
 type FilePiecesQueue struct {
@@ -67,13 +114,125 @@ type FilePiecesQueue struct {
 	FilePieces		[]FilePiece
 	TotalPieceCount	int
 	Completed 		int
+	Skipped			int // Pieces not selected for download
+	Stats			*utils.TransferStats
+	Picker			PiecePicker
+	availability	[]int // Number of connected peers that have each piece
+	inProgress		map[int]*FilePiece // Pieces popped and being downloaded
+	have			Bitfield // Pieces downloaded, verified and written to disk
+	done			chan struct{}
 }
 
-// Safely increments the counter for pieces download complete
-func (queue *FilePiecesQueue) IncrementCompleted() {
+// Create the queue of file pieces that need to be downloaded, pieces set
+// in the completed bitfield (if any) are already on disk so they are not
+// added to the queue
+func NewFilePiecesQueue(
+	filePieces []FilePiece,
+	completed Bitfield,
+	stats *utils.TransferStats,
+) FilePiecesQueue {
+	queue := FilePiecesQueue{
+		mu: &sync.Mutex{},
+		FilePieces: []FilePiece{},
+		TotalPieceCount: len(filePieces),
+		Stats: stats,
+		Picker: &RarestFirstPicker{RandomFirstCount: RANDOM_FIRST_PIECES},
+		availability: make([]int, len(filePieces)),
+		inProgress: map[int]*FilePiece{},
+		have: NewBitfield(len(filePieces)),
+		done: make(chan struct{}),
+	}
+
+	for _, piece := range filePieces {
+		if completed.HasPiece(piece.Index) {
+			queue.have.SetPiece(piece.Index)
+			queue.Completed += 1
+			if stats != nil {
+				stats.SubtractLeft(piece.Length)
+			}
+		} else {
+			queue.FilePieces = append(queue.FilePieces, piece)
+		}
+	}
+
+	if queue.remaining() == 0 {
+		close(queue.done)
+	}
+	return queue
+}
+
+// Get the number of pieces that are left to download, either in the
+// queue or in progress, must be called while holding the lock
+func (queue *FilePiecesQueue) remaining() int {
+	return len(queue.FilePieces) + len(queue.inProgress)
+}
+
+// Skip downloading the pieces that are not set in the wanted bitfield,
+// eg: when only some of the files are selected. Must be called before
+// the download begins
+func (queue *FilePiecesQueue) SkipPieces(wanted Bitfield) {
 	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	filePieces := []FilePiece{}
+	for _, piece := range queue.FilePieces {
+		if wanted.HasPiece(piece.Index) {
+			filePieces = append(filePieces, piece)
+			continue
+		}
+		queue.Skipped += 1
+		if queue.Stats != nil {
+			queue.Stats.SubtractLeft(piece.Length)
+		}
+	}
+	queue.FilePieces = filePieces
+
+	if queue.remaining() == 0 && queue.Skipped > 0 {
+		close(queue.done)
+	}
+}
+
+// Safely get a copy of the bitfield of pieces we have
+func (queue *FilePiecesQueue) GetBitfield() Bitfield {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return append(Bitfield{}, queue.have...)
+}
+
+// Safely check if we have the piece with the provided index
+func (queue *FilePiecesQueue) HasPiece(index int) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.have.HasPiece(index)
+}
+
+// Safely increments the counter for pieces download complete and
+// updates the bytes left to download
+func (queue *FilePiecesQueue) IncrementCompleted(piece *FilePiece) {
+	queue.mu.Lock()
+	delete(queue.inProgress, piece.Index)
+	queue.have.SetPiece(piece.Index)
 	queue.Completed += 1
+	if queue.remaining() == 0 {
+		close(queue.done)
+	}
 	queue.mu.Unlock()
+
+	if queue.Stats != nil {
+		queue.Stats.SubtractLeft(piece.Length)
+	}
+}
+
+// Returns a channel that is closed once all the pieces are downloaded
+func (queue *FilePiecesQueue) Done() <-chan struct{} {
+	return queue.done
+}
+
+// Safely check if all the wanted pieces have been downloaded
+func (queue *FilePiecesQueue) IsComplete() bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.remaining() == 0
 }
 
 // Safely log the current progress and peer count of the download
@@ -82,7 +241,7 @@ func (queue *FilePiecesQueue) LogProgress(pc *utils.PeerCount) {
 	formattedTime := now.Format(TIME_FORMAT)
 	queue.mu.Lock()
 	completed := float64(queue.Completed)
-	percentCompleted := (completed / float64(queue.TotalPieceCount)) * 100
+	percentCompleted := (completed / float64(queue.TotalPieceCount - queue.Skipped)) * 100
 	queue.mu.Unlock()
 	formattedPercentage := fmt.Sprintf("%.2f%%", percentCompleted)
 	currentPeerCount := 0
@@ -95,18 +254,146 @@ func (queue *FilePiecesQueue) LogProgress(pc *utils.PeerCount) {
 	)
 }
 
-// Safely pop next available FilePiece from File Piece Queue
-func (queue *FilePiecesQueue) PopPiece() (FilePiece, error) {
-	var piece FilePiece
-	var err error
+var ErrNoMorePieces = errors.New("No more pieces to process")
+var ErrNoAvailablePieces = errors.New("Peer has none of the remaining pieces")
+
+// Safely pop next available FilePiece from File Piece Queue that the peer
+// with the provided bitfield actually has
+func (queue *FilePiecesQueue) PopPiece(bitfield Bitfield) (*FilePiece, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if len(queue.FilePieces) == 0 {
+		return nil, ErrNoMorePieces
+	}
+
+	i := queue.Picker.PickPiece(queue.FilePieces, bitfield, queue.availability, queue.Completed)
+	if i == -1 {
+		return nil, ErrNoAvailablePieces
+	}
+
+	piece := queue.FilePieces[i]
+	queue.FilePieces = append(queue.FilePieces[:i], queue.FilePieces[i+1:]...)
+
+	// Track the piece while it is being downloaded so it can be shared
+	// with other peers in endgame mode
+	piece.downloaders = 1
+	queue.inProgress[piece.Index] = &piece
+	return &piece, nil
+}
+
+// Safely pop the FilePiece with the provided index if it is still in the
+// queue, eg: a piece a peer suggested we download from it
+func (queue *FilePiecesQueue) PopPieceIndex(index int) (*FilePiece, bool) {
 	queue.mu.Lock()
-	if len(queue.FilePieces) > 0 {
-		piece, queue.FilePieces = queue.FilePieces[0], queue.FilePieces[1:]
-	} else {
-		err = errors.New("No more pieces to process")
+	defer queue.mu.Unlock()
+
+	for i, piece := range queue.FilePieces {
+		if piece.Index != index {
+			continue
+		}
+		queue.FilePieces = append(queue.FilePieces[:i], queue.FilePieces[i+1:]...)
+		piece.downloaders = 1
+		queue.inProgress[piece.Index] = &piece
+		return &piece, true
+	}
+	return nil, false
+}
+
+// Clear the piece content and put it back in the queue, must be called
+// while holding the lock
+func (queue *FilePiecesQueue) resetPiece(piece *FilePiece) {
+	if queue.inProgress[piece.Index] == piece {
+		delete(queue.inProgress, piece.Index)
+	}
+	piece.PieceContent = []byte{}
+	piece.BlocksReceived = nil
+	piece.ReceivedCount = 0
+	piece.downloaders = 0
+	queue.FilePieces = append(queue.FilePieces, *piece)
+}
+
+// Safely check if the piece is still being downloaded, i.e. it was not
+// completed or put back in the queue
+func (queue *FilePiecesQueue) IsActive(piece *FilePiece) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.inProgress[piece.Index] == piece && !piece.IsComplete()
+}
+
+// Safely check if the block of the piece was already downloaded
+func (queue *FilePiecesQueue) HasBlock(piece *FilePiece, blockIndex int) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return piece.HasBlock(blockIndex)
+}
+
+// Safely add a downloaded block to the piece, returns whether the block
+// was new and whether it completed the piece. Only the caller that adds
+// the final block is told the piece completed
+func (queue *FilePiecesQueue) AddBlock(piece *FilePiece, begin int, block []byte) (bool, bool, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.inProgress[piece.Index] != piece || piece.IsComplete() {
+		return false, false, nil
+	}
+
+	receivedBefore := piece.ReceivedCount
+	err := piece.AddBlock(begin, block)
+	if err != nil {
+		return false, false, err
+	}
+
+	added := piece.ReceivedCount > receivedBefore
+	return added, added && piece.IsComplete(), nil
+}
+
+// Safely stop downloading the piece from a peer, once no peers are left
+// downloading it the piece is put back in the queue
+func (queue *FilePiecesQueue) ReleasePiece(piece *FilePiece) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if queue.inProgress[piece.Index] != piece || piece.IsComplete() {
+		return
+	}
+
+	piece.downloaders--
+	if piece.downloaders <= 0 {
+		queue.resetPiece(piece)
+	}
+}
+
+// Safely record that a peer has all the pieces in the bitfield
+func (queue *FilePiecesQueue) AddAvailability(bitfield Bitfield) {
+	queue.mu.Lock()
+	for index := range queue.availability {
+		if bitfield.HasPiece(index) {
+			queue.availability[index]++
+		}
+	}
+	queue.mu.Unlock()
+}
+
+// Safely record that a peer with the bitfield is no longer available
+func (queue *FilePiecesQueue) RemoveAvailability(bitfield Bitfield) {
+	queue.mu.Lock()
+	for index := range queue.availability {
+		if bitfield.HasPiece(index) {
+			queue.availability[index]--
+		}
+	}
+	queue.mu.Unlock()
+}
+
+// Safely record that a peer now has the piece with the provided index
+func (queue *FilePiecesQueue) IncrementAvailability(index int) {
+	queue.mu.Lock()
+	if index >= 0 && index < len(queue.availability) {
+		queue.availability[index]++
 	}
 	queue.mu.Unlock()
-	return piece, err
 }
 
 // Safely add FilePiece to File Piece Queue, this is used to retry failed
@@ -117,18 +404,79 @@ func (queue *FilePiecesQueue) InsertPiece(piece FilePiece) {
 	queue.mu.Unlock()
 }
 
+type fileDict struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
 type infoDict struct {
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
-	Length      int    `bencode:"length"`
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Length      int        `bencode:"length,omitempty"`
+	Files       []fileDict `bencode:"files,omitempty"`
+	Private     int        `bencode:"private,omitempty"`
 }
 
 type Torrent struct {
-	Announce string   `bencode:"announce"`
-	Info     infoDict `bencode:"info"`
-	InfoHash [20]byte
-	PeerId	 string
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	Info         infoDict   `bencode:"info"`
+	InfoHash     [20]byte
+	PeerId	     string
+	Port         int                  `bencode:"-"` // Port we accept peer connections on
+	Stats        *utils.TransferStats `bencode:"-"`
+	RawInfo	     []byte          `bencode:"-"` // Exact bencoded bytes of `info`
+	Metadata     utils.RawDict   `bencode:"-"` // All top-level keys of the .torrent file
+	Trackers     *TrackerManager `bencode:"-"`
+	Resume       *ResumeData     `bencode:"-"` // Trusted resume data of the download, if any
+}
+
+// Returns true if the torrent describes a directory of files rather
+// than a single file
+func (t *Torrent) IsMultiFile() bool {
+	return len(t.Info.Files) > 0
+}
+
+// Check if the torrent is private (BEP 27), ie: peers may only be found
+// through its trackers. The `private` key is part of the info hash as
+// the hash is computed over the exact bytes of `info`
+func (t *Torrent) IsPrivate() bool {
+	return t.Info.Private == 1
+}
+
+// Sources peers are found through
+const (
+	PEER_SOURCE_TRACKER = "tracker"
+	PEER_SOURCE_RESUME = "resume" // Peers known from the last run
+	PEER_SOURCE_MAGNET = "magnet" // Peers found while fetching the metadata
+	PEER_SOURCE_DHT = "dht"
+	PEER_SOURCE_PEX = "pex"
+	PEER_SOURCE_LSD = "lsd"
+)
+
+// Check if peers may be found through the source, every source of peers
+// must go through here before it is used. Private torrents only use the
+// peers their trackers return for them, never the peer lists shared with
+// other info hashes on the DHT, the local network or through PEX
+func (t *Torrent) AllowsPeerSource(source string) bool {
+	if !t.IsPrivate() {
+		return true
+	}
+	return source == PEER_SOURCE_TRACKER || source == PEER_SOURCE_RESUME
+}
+
+// Returns the total length in bytes of all the content in the torrent
+func (t *Torrent) TotalLength() int {
+	if !t.IsMultiFile() {
+		return t.Info.Length
+	}
+
+	totalLength := 0
+	for _, file := range t.Info.Files {
+		totalLength += file.Length
+	}
+	return totalLength
 }
 
 // Generate random peer ID for torrent session
@@ -138,30 +486,56 @@ func (t *Torrent) GeneratePeerId() {
 	t.PeerId = "-LI1000-" + randomStr
 }
 
-// Generate the SHA1 Hash for the content of Info in torrent file
+// Generate the SHA1 Hash for the content of Info in torrent file, this
+// hashes the exact bytes of the `info` dictionary from the original file
+// so keys not modelled in infoDict are still accounted for
 func (t *Torrent) GenerateInfoHashSHA1() {
-	bencodedInfo := bytes.NewBuffer([]byte{})
-	bencode.Marshal(bencodedInfo, t.Info)
-    infoHash := sha1.Sum(bencodedInfo.Bytes())
-    t.InfoHash = infoHash
+	infoHash := sha1.Sum(t.RawInfo)
+	t.InfoHash = infoHash
 }
 
-// This function does alot of the initial heavy lifting:
-//   - Decodes .torrent file and populate its values in Torrent struct
-//   - Builds queue for file pieces that need to be downloaded
-//   - Initializes the download file to write to with downloaded data
-func ParseTorrentFile(filePath string) (Torrent, FilePiecesQueue, os.File) {
-	torrentFile, err := os.Open(filePath)
+// Re-emit the .torrent file byte-for-byte as it was originally decoded
+func (t *Torrent) Bytes() []byte {
+	return t.Metadata.Encode()
+}
+
+// Decode the content of a .torrent file, capturing the exact byte span
+// of the `info` dictionary alongside the parsed values
+func DecodeTorrent(data []byte) (Torrent, error) {
+	torrent := Torrent{}
+
+	err := bencode.Unmarshal(bytes.NewReader(data), &torrent)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return torrent, err
 	}
 
-	defer torrentFile.Close()
+	metadata, rawErr := utils.DecodeRawDict(data)
+	if rawErr != nil {
+		return torrent, rawErr
+	}
 
-	torrent := Torrent{}
+	rawInfo, ok := metadata.Get("info")
+	if !ok || len(rawInfo) == 0 || rawInfo[0] != 'd' {
+		return torrent, errors.New("Missing info dictionary")
+	}
+
+	torrent.Metadata = metadata
+	torrent.RawInfo = rawInfo
+	torrent.Trackers = NewTrackerManager(torrent.Announce, torrent.AnnounceList)
+	torrent.Stats = utils.NewTransferStats(int64(torrent.TotalLength()))
+	torrent.Port = DEFAULT_PORT
+	return torrent, nil
+}
+
+// Read and decode the .torrent file, initializing the torrent session data
+func LoadTorrentFile(filePath string) Torrent {
+	torrentData, err := os.ReadFile(filePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	err = bencode.Unmarshal(torrentFile, &torrent)
+	torrent, err := DecodeTorrent(torrentData)
 
 	if err != nil {
 		fmt.Println("Invalid .torrent file:", err)
@@ -172,48 +546,170 @@ func ParseTorrentFile(filePath string) (Torrent, FilePiecesQueue, os.File) {
 	torrent.GeneratePeerId()
 	torrent.GenerateInfoHashSHA1()
 
+	return torrent
+}
+
+// This function does alot of the initial heavy lifting:
+//   - Decodes .torrent file and populate its values in Torrent struct
+//   - Builds queue for file pieces that need to be downloaded
+//   - Initializes the download file(s) to write to with downloaded data
+func ParseTorrentFile(filePath string) (Torrent, FilePiecesQueue, DownloadStorage) {
+	torrent := LoadTorrentFile(filePath)
+	return PrepareDownload(torrent, nil)
+}
+
+// Initializes the download file(s) of the torrent and builds the queue of
+// the pieces that still need to be downloaded. If selectedFiles is not
+// nil, only the pieces of the files with those indices are downloaded
+func PrepareDownload(torrent Torrent, selectedFiles []int) (Torrent, FilePiecesQueue, DownloadStorage) {
 	fmt.Println("Downloading:", torrent.Info.Name)
 
-	// Build queue for pieces that need to be downloaded
+	// Check the resume data before the download file(s) are initialized,
+	// it is only trusted if they are unchanged since it was saved
+	existing := torrent.DownloadExists()
+	resume, resumeErr := torrent.LoadResumeData()
+	if existing && resumeErr == nil && torrent.ResumeDataMatches(resume) {
+		torrent.Resume = &resume
+		torrent.Stats.SetTransferred(resume.Uploaded, resume.Downloaded)
+	}
+
+	// Initializing the download file(s), keeping any existing data
+	storage := torrent.InitializeDownloadStorage()
+
+	// Recheck the data of an interrupted download without trusted resume
+	// data, so only the missing pieces are downloaded
 	filePieces := torrent.GetFilePieces()
-	filePiecesQueue := FilePiecesQueue{
-		mu: &sync.Mutex{},
-		FilePieces: filePieces,
-		TotalPieceCount: len(filePieces),
+	verified := NewBitfield(len(filePieces))
+	if torrent.Resume != nil {
+		fmt.Println("Resuming from:", torrent.ResumeFilePath())
+		verified = Bitfield(torrent.Resume.Pieces)
+	} else if existing {
+		fmt.Println("Verifying existing data:", torrent.Info.Name)
+		verified = torrent.VerifyPieces(filePieces, &storage)
+	}
+
+	// Build queue for pieces that need to be downloaded
+	filePiecesQueue := NewFilePiecesQueue(filePieces, verified, torrent.Stats)
+	if selectedFiles != nil {
+		wanted, selectErr := torrent.GetFilesBitfield(selectedFiles)
+		if selectErr != nil {
+			fmt.Println("Invalid file selection:", selectErr)
+			os.Exit(1)
+		}
+		filePiecesQueue.SkipPieces(wanted)
 	}
 	filePiecesQueue.LogProgress(nil)
 
-	// Initializing the download file
-	file := torrent.InitializeDownloadFile()
+	return torrent, filePiecesQueue, storage
+}
+
+// Decodes the .torrent file and checks which pieces of its existing
+// file(s) are valid, without downloading anything
+func VerifyTorrentFile(filePath string) (Torrent, Bitfield) {
+	torrent := LoadTorrentFile(filePath)
 
-	return torrent, filePiecesQueue, file
+	storage, storageErr := torrent.OpenDownloadStorage()
+	if storageErr != nil {
+		fmt.Println("Failed to open downloaded file(s):", storageErr)
+		os.Exit(1)
+	}
+	defer storage.Close()
+
+	fmt.Println("Verifying:", torrent.Info.Name)
+	verified := torrent.VerifyPieces(torrent.GetFilePieces(), &storage)
+
+	return torrent, verified
 }
 
-// Initialize file to download to with the appropriate length
-func (t *Torrent) InitializeDownloadFile() os.File {
-	file, fileErr := os.Create(t.Info.Name)
-	if fileErr != nil {
-		fmt.Println("Failed to create file", fileErr)
+// Decodes the .torrent file and opens its existing, already downloaded
+// file(s) for seeding. Every piece is verified, and the process exits if
+// any of them are missing or corrupted
+func ParseTorrentFileForSeeding(filePath string) (Torrent, FilePiecesQueue, DownloadStorage) {
+	torrent := LoadTorrentFile(filePath)
+
+	storage, storageErr := torrent.OpenDownloadStorage()
+	if storageErr != nil {
+		fmt.Println("Failed to open downloaded file(s):", storageErr)
 		os.Exit(1)
 	}
 
-	truncErr := file.Truncate(int64(t.Info.Length))
-	if truncErr != nil {
-		fmt.Println("Failed to initialize file", truncErr)
+	fmt.Println("Verifying:", torrent.Info.Name)
+	filePieces := torrent.GetFilePieces()
+	verified := torrent.VerifyPieces(filePieces, &storage)
+	if verified.Count() != len(filePieces) {
+		fmt.Printf(
+			"Download is incomplete, only %d/%d pieces are valid\n",
+			verified.Count(), len(filePieces),
+		)
 		os.Exit(1)
 	}
 
-	return *file
+	fmt.Println("Seeding:", torrent.Info.Name)
+	filePiecesQueue := NewFilePiecesQueue(filePieces, verified, torrent.Stats)
+
+	return torrent, filePiecesQueue, storage
+}
+
+// Initialize the file(s) to download to with the appropriate lengths,
+// creating the directory layout for multi-file torrents. Existing file(s)
+// are kept as is, apart from being resized
+func (t *Torrent) InitializeDownloadStorage() DownloadStorage {
+	downloadFiles, layoutErr := t.GetDownloadFiles()
+	if layoutErr != nil {
+		fmt.Println("Invalid file layout in .torrent file:", layoutErr)
+		os.Exit(1)
+	}
+
+	for i := range downloadFiles {
+		downloadFile := &downloadFiles[i]
+
+		dirErr := os.MkdirAll(filepath.Dir(downloadFile.Path), 0755)
+		if dirErr != nil {
+			fmt.Println("Failed to create directory", dirErr)
+			os.Exit(1)
+		}
+
+		// Open without truncating so interrupted downloads can be resumed
+		file, fileErr := os.OpenFile(downloadFile.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if fileErr != nil {
+			fmt.Println("Failed to create file", fileErr)
+			os.Exit(1)
+		}
+
+		// Only resize when needed, so the modification time of complete
+		// files still matches the resume data
+		info, statErr := file.Stat()
+		if statErr != nil || info.Size() != int64(downloadFile.Length) {
+			truncErr := file.Truncate(int64(downloadFile.Length))
+			if truncErr != nil {
+				fmt.Println("Failed to initialize file", truncErr)
+				os.Exit(1)
+			}
+		}
+
+		downloadFile.File = file
+	}
+
+	return DownloadStorage{Files: downloadFiles}
 }
 
 // Returns number of pieces needed to download along with
 // remaining bytes in last piece
 func (t *Torrent) GetFilePiecesCount() (int, int) {
-	pieceCount := t.Info.Length / t.Info.PieceLength
-	finalPieceBytes := t.Info.Length % t.Info.PieceLength
+	totalLength := t.TotalLength()
+	pieceCount := totalLength / t.Info.PieceLength
+	finalPieceBytes := totalLength % t.Info.PieceLength
 	return pieceCount, finalPieceBytes
 }
 
+// Returns the offset within the torrent's contiguous data and the length
+// of the piece with the provided index
+func (t *Torrent) GetPieceBounds(index int) (int, int) {
+	offset := index * t.Info.PieceLength
+	length := min(t.Info.PieceLength, t.TotalLength() - offset)
+	return offset, length
+}
+
 // Returns instances of `FilePiece` containing information about
 // all the file pieces that need to be downloaded for the torrent
 func (t *Torrent) GetFilePieces() ([]FilePiece) {
@@ -255,47 +751,172 @@ func (t *Torrent) GetFilePieces() ([]FilePiece) {
 	return filePieces
 }
 
+type AnnounceParams struct {
+	InfoHash	[20]byte
+	PeerId		string
+	Port		int
+	Uploaded	int64
+	Downloaded	int64
+	Left		int64
+	Event		string
+	TrackerId	string // `tracker id` returned by the tracker last time
+}
+
+// Returns the parameters to announce to the tracker with, reporting the
+// current transfer stats of the torrent
+func (t *Torrent) GetAnnounceParams(event string) AnnounceParams {
+	uploaded, downloaded, left := t.Stats.Get()
+	return AnnounceParams{
+		InfoHash: t.InfoHash,
+		PeerId: t.PeerId,
+		Port: t.Port,
+		Uploaded: uploaded,
+		Downloaded: downloaded,
+		Left: left,
+		Event: event,
+	}
+}
+
 // Build tracker request URL with required query params
-func (t *Torrent) GenerateTrackerRequestURL() (string) {
-    // Build request url query params
+func (t *Torrent) GenerateTrackerRequestURL(announceURL string, params AnnounceParams) (string) {
+	// Build request url query params
 	queryParams := url.Values{}
-	queryParams.Add("info_hash", string(t.InfoHash[:]))
-	queryParams.Add("peer_id", t.PeerId)
-	queryParams.Add("port", "6889")
-	queryParams.Add("uploaded", "0")
-	queryParams.Add("downloaded", "0")
-	queryParams.Add("left", strconv.Itoa(t.Info.Length))
-	queryParams.Add("event", "started")
-
-	url := t.Announce + "?" + queryParams.Encode()
+	queryParams.Add("info_hash", string(params.InfoHash[:]))
+	queryParams.Add("peer_id", params.PeerId)
+	queryParams.Add("port", strconv.Itoa(params.Port))
+	queryParams.Add("uploaded", strconv.FormatInt(params.Uploaded, 10))
+	queryParams.Add("downloaded", strconv.FormatInt(params.Downloaded, 10))
+	queryParams.Add("left", strconv.FormatInt(params.Left, 10))
+	if params.Event != "" {
+		queryParams.Add("event", params.Event)
+	}
+	if params.TrackerId != "" {
+		queryParams.Add("trackerid", params.TrackerId)
+	}
+	queryParams.Add("compact", "1")
+
+	// Some trackers already include query params (eg: a passkey)
+	separator := "?"
+	if strings.Contains(announceURL, "?") {
+		separator = "&"
+	}
+
+	url := announceURL + separator + queryParams.Encode()
 	return url
 }
 
-// Performs the announce request to the tracker returning interval
-// and peer data
-func (t *Torrent) AnnounceToTracker() (int64, map[string]interface{}) {
-	url := t.GenerateTrackerRequestURL()
-
-	response, err := http.Get(url)
+// Performs the announce request to an HTTP tracker
+func (t *Torrent) announceHTTP(announceURL string, params AnnounceParams) (map[string]interface{}, error) {
+	url := t.GenerateTrackerRequestURL(announceURL, params)
 
+	client := &http.Client{Timeout: HTTP_ANNOUNCE_TIMEOUT}
+	response, err := client.Get(url)
 	if err != nil {
-		fmt.Println("Failed to reach Tracker:", err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	defer response.Body.Close()
 
 	data, parseErr := utils.ParseBencodeResponse(response.Body)
-
 	if parseErr != nil {
-		fmt.Println("Failed to parse Tracker response body: ", parseErr)
-		os.Exit(1)
+		return nil, parseErr
+	}
+
+	return data, nil
+}
+
+// Performs the announce request to a UDP tracker, the response is
+// converted to the same format returned by HTTP trackers
+func (t *Torrent) announceUDP(trackerURL *url.URL, params AnnounceParams) (map[string]interface{}, error) {
+	tracker := GetUDPTracker(trackerURL.Host)
+	response, err := tracker.Announce(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert peers to the compact format (BEP 23 and BEP 7)
+	peers := []byte{}
+	peers6 := []byte{}
+	for _, peer := range response.Peers {
+		port := []byte{byte(peer.Port >> 8), byte(peer.Port)}
+		if ip4 := peer.IP.To4(); ip4 != nil {
+			peers = append(peers, ip4...)
+			peers = append(peers, port...)
+		} else {
+			peers6 = append(peers6, peer.IP.To16()...)
+			peers6 = append(peers6, port...)
+		}
+	}
+
+	data := map[string]interface{}{
+		"interval": int64(response.Interval),
+		"complete": int64(response.Seeders),
+		"incomplete": int64(response.Leechers),
+		"peers": string(peers),
+		"peers6": string(peers6),
+	}
+	return data, nil
+}
+
+// Performs the announce request to the tracker at the provided URL,
+// selecting the tracker protocol based on the URL scheme
+func (t *Torrent) AnnounceTo(announceURL string, params AnnounceParams) (map[string]interface{}, error) {
+	trackerURL, urlErr := url.Parse(announceURL)
+	if urlErr != nil {
+		return nil, urlErr
+	}
+
+	var data map[string]interface{}
+	var err error
+	switch trackerURL.Scheme {
+	case "http", "https":
+		params.TrackerId = t.Trackers.TrackerId(announceURL)
+		data, err = t.announceHTTP(announceURL, params)
+	case "udp":
+		data, err = t.announceUDP(trackerURL, params)
+	default:
+		err = errors.New("Unsupported tracker protocol: " + trackerURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if failReason, announceFailed := data["failure reason"]; announceFailed {
-		fmt.Println("Announce failed: ", failReason)
-		os.Exit(1)
+		return nil, fmt.Errorf("%v", failReason)
+	}
+
+	if _, ok := data["interval"].(int64); !ok {
+		return nil, errors.New("Missing interval in tracker response")
+	}
+
+	// Echo the tracker id back on the next announces to this tracker
+	if trackerId, ok := data["tracker id"].(string); ok && trackerId != "" {
+		t.Trackers.SetTrackerId(announceURL, trackerId)
+	}
+
+	return data, nil
+}
+
+// Performs the announce request to the trackers with the provided event,
+// returning the shortest interval and the largest min interval along with
+// the peer data from every tier that responded
+func (t *Torrent) AnnounceToTrackers(event string) (int64, int64, []map[string]interface{}, error) {
+	params := t.GetAnnounceParams(event)
+	responses, err := t.Trackers.Announce(func(announceURL string) (map[string]interface{}, error) {
+		return t.AnnounceTo(announceURL, params)
+	})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	interval := responses[0]["interval"].(int64)
+	var minInterval int64
+	for _, data := range responses {
+		interval = min(interval, data["interval"].(int64))
+		if trackerMinInterval, ok := data["min interval"].(int64); ok {
+			minInterval = max(minInterval, trackerMinInterval)
+		}
 	}
 
-	return data["interval"].(int64), data
+	return interval, min(minInterval, interval), responses, nil
 }
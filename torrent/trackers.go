@@ -0,0 +1,159 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Manages the tiers of trackers from `announce-list` as described in
+// BEP 12, see: https://www.bittorrent.org/beps/bep_0012.html
+type TrackerManager struct {
+	mu			*sync.Mutex
+	Tiers		[][]string
+	trackerIds	map[string]string
+}
+
+type trackerResponse struct {
+	Data	map[string]interface{}
+	Err		error
+}
+
+// Build the tracker tiers from `announce-list`, falling back to `announce`
+// when it is not available. The trackers within each tier are shuffled
+func NewTrackerManager(announce string, announceList [][]string) *TrackerManager {
+	tiers := [][]string{}
+	for _, tier := range announceList {
+		trackers := []string{}
+		for _, tracker := range tier {
+			if tracker != "" {
+				trackers = append(trackers, tracker)
+			}
+		}
+		if len(trackers) == 0 {
+			continue
+		}
+		rand.Shuffle(len(trackers), func(i, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+		tiers = append(tiers, trackers)
+	}
+
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+
+	return &TrackerManager{
+		mu: &sync.Mutex{},
+		Tiers: tiers,
+		trackerIds: map[string]string{},
+	}
+}
+
+// Get the `tracker id` the tracker returned in its last response, if any
+func (tm *TrackerManager) TrackerId(tracker string) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.trackerIds[tracker]
+}
+
+// Remember the `tracker id` the tracker returned, to send it back on the
+// following announces
+func (tm *TrackerManager) SetTrackerId(tracker string, trackerId string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.trackerIds[tracker] = trackerId
+}
+
+// Returns a copy of the trackers in the tier
+func (tm *TrackerManager) getTier(tierIndex int) []string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return append([]string{}, tm.Tiers[tierIndex]...)
+}
+
+// Returns all the trackers, tier by tier
+func (tm *TrackerManager) All() []string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	trackers := []string{}
+	for _, tier := range tm.Tiers {
+		trackers = append(trackers, tier...)
+	}
+	return trackers
+}
+
+// Move the tracker to the front of its tier after a successful announce
+func (tm *TrackerManager) promote(tierIndex int, tracker string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tier := tm.Tiers[tierIndex]
+	for i, existing := range tier {
+		if existing == tracker {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = tracker
+			return
+		}
+	}
+}
+
+// Try the trackers in the tier in order until one of them succeeds
+func (tm *TrackerManager) announceTier(
+	tierIndex int,
+	announce func(string) (map[string]interface{}, error),
+) (map[string]interface{}, error) {
+	var lastErr error
+	for _, tracker := range tm.getTier(tierIndex) {
+		data, err := announce(tracker)
+		if err != nil {
+			fmt.Println("Announce to", tracker, "failed:", err)
+			lastErr = err
+			continue
+		}
+		tm.promote(tierIndex, tracker)
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// Announce to every tier in parallel, using the first working tracker in
+// each, and return the responses of all the tiers that succeeded
+func (tm *TrackerManager) Announce(
+	announce func(string) (map[string]interface{}, error),
+) ([]map[string]interface{}, error) {
+	tm.mu.Lock()
+	tierCount := len(tm.Tiers)
+	tm.mu.Unlock()
+
+	if tierCount == 0 {
+		return nil, errors.New("No trackers available")
+	}
+
+	results := make([]trackerResponse, tierCount)
+	var wg sync.WaitGroup
+	for i := 0; i < tierCount; i++ {
+		wg.Add(1)
+		go func(tierIndex int) {
+			defer wg.Done()
+			data, err := tm.announceTier(tierIndex, announce)
+			results[tierIndex] = trackerResponse{Data: data, Err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	responses := []map[string]interface{}{}
+	for _, result := range results {
+		if result.Err == nil {
+			responses = append(responses, result.Data)
+		}
+	}
+
+	if len(responses) == 0 {
+		return nil, errors.New("All trackers failed")
+	}
+
+	return responses, nil
+}
@@ -0,0 +1,336 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP Tracker Protocol, see: https://www.bittorrent.org/beps/bep_0015.html
+const UDP_PROTOCOL_ID = 0x41727101980
+const UDP_BASE_TIMEOUT = 15 * time.Second
+const UDP_CONNECTION_ID_TTL = time.Minute
+const UDP_MAX_PACKET_SIZE = 2048
+
+// BEP 15 retransmits up to 8 times, which takes hours for a tracker that is
+// down. Requests give up much sooner so the next tracker is tried instead
+const UDP_MAX_RETRANSMISSIONS = 2
+const UDP_REQUEST_TIMEOUT = time.Minute
+
+const (
+	UDP_ACTION_CONNECT = iota
+	UDP_ACTION_ANNOUNCE
+	UDP_ACTION_SCRAPE
+	UDP_ACTION_ERROR
+)
+
+const (
+	UDP_EVENT_NONE = iota
+	UDP_EVENT_COMPLETED
+	UDP_EVENT_STARTED
+	UDP_EVENT_STOPPED
+)
+
+// Map the HTTP tracker event names to their UDP tracker event codes
+var udpEvents = map[string]uint32{
+	"":          UDP_EVENT_NONE,
+	"completed": UDP_EVENT_COMPLETED,
+	"started":   UDP_EVENT_STARTED,
+	"stopped":   UDP_EVENT_STOPPED,
+}
+
+type UDPAnnounceResponse struct {
+	Interval	int
+	Leechers	int
+	Seeders		int
+	Peers		[]UDPPeer
+}
+
+type UDPPeer struct {
+	IP		net.IP
+	Port	int
+}
+
+type ScrapeResult struct {
+	Complete	int // Seeders
+	Downloaded	int // Number of times the download completed
+	Incomplete	int // Leechers
+}
+
+type UDPTracker struct {
+	Address				string
+	BaseTimeout			time.Duration
+	MaxRetransmissions	int
+	Timeout				time.Duration // Overall time allowed for a request, including connecting
+	mu					*sync.Mutex
+	key					uint32
+	connectionId		uint64
+	connectionIdExpiry	time.Time
+}
+
+var udpTrackersMu = &sync.Mutex{}
+var udpTrackers = map[string]*UDPTracker{}
+
+// Create a UDP tracker client for the provided host:port address
+func NewUDPTracker(address string) *UDPTracker {
+	return &UDPTracker{
+		Address: address,
+		BaseTimeout: UDP_BASE_TIMEOUT,
+		MaxRetransmissions: UDP_MAX_RETRANSMISSIONS,
+		Timeout: UDP_REQUEST_TIMEOUT,
+		mu: &sync.Mutex{},
+		key: randomUint32(),
+	}
+}
+
+// Get the shared UDP tracker client for the address, so the connection
+// ID is cached across announces to the same tracker
+func GetUDPTracker(address string) *UDPTracker {
+	udpTrackersMu.Lock()
+	defer udpTrackersMu.Unlock()
+
+	tracker, exists := udpTrackers[address]
+	if !exists {
+		tracker = NewUDPTracker(address)
+		udpTrackers[address] = tracker
+	}
+	return tracker
+}
+
+// Generate a random 32-bit integer for transaction IDs and keys
+func randomUint32() uint32 {
+	buffer := make([]byte, 4)
+	rand.Read(buffer)
+	return binary.BigEndian.Uint32(buffer)
+}
+
+// Returns true if the error was caused by the read deadline passing
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Wait for the response matching the transaction ID, ignoring any stale
+// responses to earlier retransmissions
+func (ut *UDPTracker) readResponse(conn net.Conn, action uint32, transactionId uint32) ([]byte, error) {
+	for {
+		response := make([]byte, UDP_MAX_PACKET_SIZE)
+		n, readErr := conn.Read(response)
+		if readErr != nil {
+			return nil, readErr
+		}
+		response = response[:n]
+
+		if n < 8 || binary.BigEndian.Uint32(response[4:8]) != transactionId {
+			continue
+		}
+
+		responseAction := binary.BigEndian.Uint32(response[:4])
+		if responseAction == UDP_ACTION_ERROR {
+			return nil, errors.New("Tracker error: " + string(response[8:]))
+		} else if responseAction != action {
+			return nil, errors.New("Unexpected action in tracker response")
+		}
+
+		return response[8:], nil
+	}
+}
+
+// Perform the request with a valid connection ID, giving up once the
+// timeout passes. The connection ID is dropped if the request fails
+func (ut *UDPTracker) request(conn net.Conn, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	connectionId, connectErr := ut.getConnectionId(conn, deadline)
+	if connectErr != nil {
+		return nil, connectErr
+	}
+
+	response, err := ut.sendRequest(conn, connectionId, action, body, deadline)
+	if err != nil {
+		ut.invalidateConnectionId()
+		return nil, err
+	}
+	return response, nil
+}
+
+// Send a request to the tracker and wait for its response, retransmitting
+// after BaseTimeout * 2 ^ n as described in BEP 15, until MaxRetransmissions
+// is reached or the deadline passes
+func (ut *UDPTracker) sendRequest(
+	conn net.Conn,
+	connectionId uint64,
+	action uint32,
+	body []byte,
+	deadline time.Time,
+) ([]byte, error) {
+	for n := 0; n <= ut.MaxRetransmissions && time.Now().Before(deadline); n++ {
+		transactionId := randomUint32()
+		request := make([]byte, 16, 16+len(body))
+		binary.BigEndian.PutUint64(request[0:8], connectionId)
+		binary.BigEndian.PutUint32(request[8:12], action)
+		binary.BigEndian.PutUint32(request[12:16], transactionId)
+		request = append(request, body...)
+
+		_, writeErr := conn.Write(request)
+		if writeErr != nil {
+			return nil, writeErr
+		}
+
+		readDeadline := time.Now().Add(ut.BaseTimeout * time.Duration(1 << n))
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		response, readErr := ut.readResponse(conn, action, transactionId)
+		if readErr == nil {
+			return response, nil
+		} else if !isTimeout(readErr) {
+			return nil, readErr
+		}
+	}
+
+	return nil, errors.New("UDP tracker timed out: " + ut.Address)
+}
+
+// Returns the cached connection ID or obtains a new one if it has expired
+func (ut *UDPTracker) getConnectionId(conn net.Conn, deadline time.Time) (uint64, error) {
+	ut.mu.Lock()
+	connectionId := ut.connectionId
+	valid := time.Now().Before(ut.connectionIdExpiry)
+	ut.mu.Unlock()
+
+	if valid {
+		return connectionId, nil
+	}
+
+	return ut.connect(conn, deadline)
+}
+
+// Perform the connect request to obtain a connection ID
+func (ut *UDPTracker) connect(conn net.Conn, deadline time.Time) (uint64, error) {
+	response, err := ut.sendRequest(conn, UDP_PROTOCOL_ID, UDP_ACTION_CONNECT, []byte{}, deadline)
+	if err != nil {
+		return 0, err
+	}
+	if len(response) < 8 {
+		return 0, errors.New("Invalid connect response length")
+	}
+
+	connectionId := binary.BigEndian.Uint64(response[:8])
+	ut.mu.Lock()
+	ut.connectionId = connectionId
+	ut.connectionIdExpiry = time.Now().Add(UDP_CONNECTION_ID_TTL)
+	ut.mu.Unlock()
+
+	return connectionId, nil
+}
+
+// Clear the cached connection ID so the next request reconnects
+func (ut *UDPTracker) invalidateConnectionId() {
+	ut.mu.Lock()
+	ut.connectionIdExpiry = time.Time{}
+	ut.mu.Unlock()
+}
+
+// Open a socket to the tracker
+func (ut *UDPTracker) dial() (net.Conn, error) {
+	return net.Dial("udp", ut.Address)
+}
+
+// Perform the announce request to the tracker
+func (ut *UDPTracker) Announce(params AnnounceParams) (UDPAnnounceResponse, error) {
+	announceResponse := UDPAnnounceResponse{}
+
+	event, validEvent := udpEvents[params.Event]
+	if !validEvent {
+		return announceResponse, errors.New("Unknown announce event: " + params.Event)
+	}
+
+	conn, dialErr := ut.dial()
+	if dialErr != nil {
+		return announceResponse, dialErr
+	}
+	defer conn.Close()
+
+	body := make([]byte, 82)
+	copy(body[0:20], params.InfoHash[:])
+	copy(body[20:40], []byte(params.PeerId))
+	binary.BigEndian.PutUint64(body[40:48], uint64(params.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(params.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(params.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], event)
+	binary.BigEndian.PutUint32(body[68:72], 0) // IP address, 0 for default
+	binary.BigEndian.PutUint32(body[72:76], ut.key)
+	binary.BigEndian.PutUint32(body[76:80], 0xFFFFFFFF) // num_want, -1 for default
+	binary.BigEndian.PutUint16(body[80:82], uint16(params.Port))
+
+	response, err := ut.request(conn, UDP_ACTION_ANNOUNCE, body, ut.Timeout)
+	if err != nil {
+		return announceResponse, err
+	}
+	if len(response) < 12 {
+		return announceResponse, errors.New("Invalid announce response length")
+	}
+
+	announceResponse.Interval = int(binary.BigEndian.Uint32(response[0:4]))
+	announceResponse.Leechers = int(binary.BigEndian.Uint32(response[4:8]))
+	announceResponse.Seeders = int(binary.BigEndian.Uint32(response[8:12]))
+
+	// Peers are 6 bytes each over IPv4 and 18 bytes each over IPv6,
+	// depending on the address family of the tracker
+	ipLength := net.IPv4len
+	remoteAddr, ok := conn.RemoteAddr().(*net.UDPAddr)
+	if ok && remoteAddr.IP.To4() == nil {
+		ipLength = net.IPv6len
+	}
+
+	peersData := response[12:]
+	peerLength := ipLength + 2
+	for i := 0; i+peerLength <= len(peersData); i += peerLength {
+		announceResponse.Peers = append(announceResponse.Peers, UDPPeer{
+			IP: net.IP(peersData[i:i+ipLength]),
+			Port: int(binary.BigEndian.Uint16(peersData[i+ipLength:i+peerLength])),
+		})
+	}
+
+	return announceResponse, nil
+}
+
+// Perform the scrape request to the tracker for the provided info hashes,
+// giving up once the timeout passes
+func (ut *UDPTracker) Scrape(infoHashes [][20]byte, timeout time.Duration) ([]ScrapeResult, error) {
+	conn, dialErr := ut.dial()
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	defer conn.Close()
+
+	body := []byte{}
+	for _, infoHash := range infoHashes {
+		body = append(body, infoHash[:]...)
+	}
+
+	response, err := ut.request(conn, UDP_ACTION_SCRAPE, body, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12*len(infoHashes) {
+		return nil, errors.New("Invalid scrape response length")
+	}
+
+	results := []ScrapeResult{}
+	for i := range infoHashes {
+		offset := i * 12
+		results = append(results, ScrapeResult{
+			Complete: int(binary.BigEndian.Uint32(response[offset:offset+4])),
+			Downloaded: int(binary.BigEndian.Uint32(response[offset+4:offset+8])),
+			Incomplete: int(binary.BigEndian.Uint32(response[offset+8:offset+12])),
+		})
+	}
+
+	return results, nil
+}
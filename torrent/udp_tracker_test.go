@@ -0,0 +1,287 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A UDP tracker on loopback answering connect, announce and scrape requests
+type fakeUDPTracker struct {
+	conn				*net.UDPConn
+	mu					sync.Mutex
+	connectionId		uint64
+	connects			int
+	announces			int
+	drop				int // Requests ignored before answering, to force retransmissions
+	wrongTransaction	bool // Send a reply with the wrong transaction ID first
+	failWith			string // Answer announces with an error message
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, listenErr := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	f := &fakeUDPTracker{conn: conn}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+	return f
+}
+
+func (f *fakeUDPTracker) Address() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeUDPTracker) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects, f.announces
+}
+
+func (f *fakeUDPTracker) serve() {
+	buffer := make([]byte, UDP_MAX_PACKET_SIZE)
+	for {
+		n, addr, readErr := f.conn.ReadFromUDP(buffer)
+		if readErr != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		connectionId := binary.BigEndian.Uint64(buffer[0:8])
+		action := binary.BigEndian.Uint32(buffer[8:12])
+		transactionId := binary.BigEndian.Uint32(buffer[12:16])
+
+		f.mu.Lock()
+		if f.drop > 0 {
+			f.drop--
+			f.mu.Unlock()
+			continue
+		}
+
+		reply := func(action uint32, transactionId uint32, body []byte) {
+			header := make([]byte, 8)
+			binary.BigEndian.PutUint32(header[0:4], action)
+			binary.BigEndian.PutUint32(header[4:8], transactionId)
+			f.conn.WriteToUDP(append(header, body...), addr)
+		}
+
+		switch {
+		case action == UDP_ACTION_CONNECT && connectionId == UDP_PROTOCOL_ID:
+			f.connects++
+			f.connectionId = uint64(f.connects) << 32 | 0xbeef
+			body := make([]byte, 8)
+			binary.BigEndian.PutUint64(body, f.connectionId)
+			reply(UDP_ACTION_CONNECT, transactionId, body)
+		case connectionId != f.connectionId:
+			reply(UDP_ACTION_ERROR, transactionId, []byte("Invalid connection ID"))
+		case action == UDP_ACTION_ANNOUNCE:
+			f.announces++
+			if f.failWith != "" {
+				reply(UDP_ACTION_ERROR, transactionId, []byte(f.failWith))
+				break
+			}
+
+			body := make([]byte, 12, 18)
+			binary.BigEndian.PutUint32(body[0:4], 1800)
+			binary.BigEndian.PutUint32(body[4:8], 2)
+			binary.BigEndian.PutUint32(body[8:12], 3)
+			body = append(body, 127, 0, 0, 1, 0x1a, 0xe1)
+			if f.wrongTransaction {
+				stale := append([]byte{}, body...)
+				binary.BigEndian.PutUint32(stale[0:4], 1)
+				reply(UDP_ACTION_ANNOUNCE, transactionId + 1, stale)
+			}
+			reply(UDP_ACTION_ANNOUNCE, transactionId, body)
+		case action == UDP_ACTION_SCRAPE:
+			body := []byte{}
+			for i := 16; i + 20 <= n; i += 20 {
+				result := make([]byte, 12)
+				binary.BigEndian.PutUint32(result[0:4], 5)
+				binary.BigEndian.PutUint32(result[4:8], 50)
+				binary.BigEndian.PutUint32(result[8:12], 10)
+				body = append(body, result...)
+			}
+			reply(UDP_ACTION_SCRAPE, transactionId, body)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func testUDPTracker(f *fakeUDPTracker) *UDPTracker {
+	tracker := NewUDPTracker(f.Address())
+	tracker.BaseTimeout = 50 * time.Millisecond
+	tracker.Timeout = 2 * time.Second
+	return tracker
+}
+
+func testAnnounceParams() AnnounceParams {
+	return AnnounceParams{
+		InfoHash: [20]byte{1, 2, 3},
+		PeerId: "-LI1000-abcdefghijkl",
+		Port: 6889,
+		Left: 100,
+		Event: "started",
+	}
+}
+
+func TestUDPTrackerConnectThenAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := testUDPTracker(f)
+
+	response, err := tracker.Announce(testAnnounceParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 1800 || response.Leechers != 2 || response.Seeders != 3 {
+		t.Errorf("Unexpected announce response: %+v", response)
+	}
+	if len(response.Peers) != 1 || !response.Peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || response.Peers[0].Port != 6881 {
+		t.Errorf("Unexpected peers: %+v", response.Peers)
+	}
+	if connects, announces := f.counts(); connects != 1 || announces != 1 {
+		t.Errorf("Expected 1 connect and 1 announce, got %d and %d", connects, announces)
+	}
+}
+
+func TestUDPTrackerConnectionIdCaching(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := testUDPTracker(f)
+
+	for i := 0; i < 3; i++ {
+		if _, err := tracker.Announce(testAnnounceParams()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if connects, announces := f.counts(); connects != 1 || announces != 3 {
+		t.Fatalf("Expected the connection ID to be reused, got %d connects for %d announces", connects, announces)
+	}
+
+	tracker.mu.Lock()
+	expiresIn := time.Until(tracker.connectionIdExpiry)
+	tracker.mu.Unlock()
+	if expiresIn <= UDP_CONNECTION_ID_TTL - 5 * time.Second || expiresIn > UDP_CONNECTION_ID_TTL {
+		t.Errorf("Expected the connection ID to expire in %v, expires in %v", UDP_CONNECTION_ID_TTL, expiresIn)
+	}
+
+	// Once the minute is up a new connection ID is obtained
+	tracker.mu.Lock()
+	tracker.connectionIdExpiry = time.Now().Add(-time.Second)
+	tracker.mu.Unlock()
+	if _, err := tracker.Announce(testAnnounceParams()); err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := f.counts(); connects != 2 {
+		t.Errorf("Expected a reconnect after the connection ID expired, got %d connects", connects)
+	}
+}
+
+func TestUDPTrackerIgnoresWrongTransactionId(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.wrongTransaction = true
+	f.mu.Unlock()
+	tracker := testUDPTracker(f)
+
+	response, err := tracker.Announce(testAnnounceParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Interval != 1800 {
+		t.Errorf("Expected the reply with the wrong transaction ID to be ignored, got interval %d", response.Interval)
+	}
+}
+
+func TestUDPTrackerErrorResponse(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.failWith = "Torrent not registered"
+	f.mu.Unlock()
+	tracker := testUDPTracker(f)
+
+	_, err := tracker.Announce(testAnnounceParams())
+	if err == nil || !strings.Contains(err.Error(), "Torrent not registered") {
+		t.Fatalf("Expected the tracker's error message, got %v", err)
+	}
+
+	// The connection ID is dropped after a failed request
+	f.mu.Lock()
+	f.failWith = ""
+	f.mu.Unlock()
+	if _, err := tracker.Announce(testAnnounceParams()); err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := f.counts(); connects != 2 {
+		t.Errorf("Expected a reconnect after the error, got %d connects", connects)
+	}
+}
+
+func TestUDPTrackerRetransmission(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.drop = 2 // The first connect and the first announce
+	f.mu.Unlock()
+	tracker := testUDPTracker(f)
+
+	_, err := tracker.Announce(testAnnounceParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connects, announces := f.counts(); connects != 1 || announces != 1 {
+		t.Errorf("Expected 1 connect and 1 announce to be answered, got %d and %d", connects, announces)
+	}
+}
+
+func TestUDPTrackerGivesUp(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.drop = 1000
+	f.mu.Unlock()
+	tracker := testUDPTracker(f)
+	tracker.BaseTimeout = 20 * time.Millisecond
+	tracker.MaxRetransmissions = 2
+
+	// 20ms + 40ms + 80ms before giving up
+	start := time.Now()
+	_, err := tracker.Announce(testAnnounceParams())
+	if err == nil {
+		t.Fatal("Expected the announce to time out")
+	}
+	if elapsed := time.Since(start); elapsed < 140 * time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected to give up after 3 attempts, took %v", elapsed)
+	}
+
+	// The overall timeout cuts the retransmissions short
+	tracker.BaseTimeout = time.Second
+	tracker.Timeout = 100 * time.Millisecond
+	start = time.Now()
+	_, err = tracker.Announce(testAnnounceParams())
+	if err == nil {
+		t.Fatal("Expected the announce to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 500 * time.Millisecond {
+		t.Errorf("Expected to give up after the %v timeout, took %v", tracker.Timeout, elapsed)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := testUDPTracker(f)
+
+	results, err := tracker.Scrape([][20]byte{{1}, {2}}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	for _, result := range results {
+		if result.Complete != 5 || result.Downloaded != 50 || result.Incomplete != 10 {
+			t.Errorf("Unexpected scrape result: %+v", result)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// A bencoded dictionary that keeps its keys in their original order along
+// with the exact encoded bytes of each value, so unknown keys are preserved
+// and the dictionary can be re-emitted byte-for-byte
+type RawDict struct {
+	Keys	[]string
+	Values	map[string][]byte
+}
+
+// Create an empty RawDict
+func NewRawDict() RawDict {
+	return RawDict{
+		Keys: []string{},
+		Values: map[string][]byte{},
+	}
+}
+
+// Get the exact encoded bytes of the value stored under key
+func (d *RawDict) Get(key string) ([]byte, bool) {
+	value, ok := d.Values[key]
+	return value, ok
+}
+
+// Set the encoded bytes of the value stored under key, new keys are
+// inserted in sorted position as required by the bencode spec
+func (d *RawDict) Set(key string, value []byte) {
+	if _, exists := d.Values[key]; !exists {
+		position := len(d.Keys)
+		for i, existingKey := range d.Keys {
+			if key < existingKey {
+				position = i
+				break
+			}
+		}
+		d.Keys = append(d.Keys, "")
+		copy(d.Keys[position+1:], d.Keys[position:])
+		d.Keys[position] = key
+	}
+	d.Values[key] = value
+}
+
+// Encode the dictionary back to bencode, keeping the original key order
+// and value bytes
+func (d *RawDict) Encode() []byte {
+	encoded := bytes.NewBuffer([]byte{})
+	encoded.WriteByte('d')
+	for _, key := range d.Keys {
+		encoded.Write(EncodeBencodeString(key))
+		encoded.Write(d.Values[key])
+	}
+	encoded.WriteByte('e')
+	return encoded.Bytes()
+}
+
+// Encode a string as a bencoded byte string
+func EncodeBencodeString(s string) []byte {
+	return []byte(strconv.Itoa(len(s)) + ":" + s)
+}
+
+// Decode a bencoded dictionary without interpreting its values, the data
+// must consist of exactly one dictionary
+func DecodeRawDict(data []byte) (RawDict, error) {
+	dict := NewRawDict()
+
+	if len(data) == 0 || data[0] != 'd' {
+		return dict, errors.New("Bencoded data is not a dictionary")
+	}
+
+	position := 1
+	for position < len(data) && data[position] != 'e' {
+		keyEnd, keyErr := scanBencodeValue(data, position)
+		if keyErr != nil {
+			return dict, keyErr
+		}
+		key, stringErr := decodeBencodeString(data[position:keyEnd])
+		if stringErr != nil {
+			return dict, errors.New("Bencoded dictionary key is not a string")
+		}
+
+		valueEnd, valueErr := scanBencodeValue(data, keyEnd)
+		if valueErr != nil {
+			return dict, valueErr
+		}
+
+		if _, duplicate := dict.Values[key]; duplicate {
+			return dict, errors.New("Duplicate key in bencoded dictionary: " + key)
+		}
+		dict.Keys = append(dict.Keys, key)
+		dict.Values[key] = data[keyEnd:valueEnd]
+		position = valueEnd
+	}
+
+	if position >= len(data) {
+		return dict, errors.New("Unterminated bencoded dictionary")
+	}
+	if position+1 != len(data) {
+		return dict, errors.New("Trailing data after bencoded dictionary")
+	}
+
+	return dict, nil
+}
+
+// Split the bencoded value at the beginning of data from the rest of the
+// data following it
+func SplitBencodeValue(data []byte) ([]byte, []byte, error) {
+	end, err := scanBencodeValue(data, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data[:end], data[end:], nil
+}
+
+// Decode a complete bencoded byte string
+func decodeBencodeString(data []byte) (string, error) {
+	colon := bytes.IndexByte(data, ':')
+	if colon < 1 {
+		return "", errors.New("Invalid bencoded string")
+	}
+	return string(data[colon+1:]), nil
+}
+
+// Returns the index just after the end of the bencoded value that
+// starts at the provided position
+func scanBencodeValue(data []byte, position int) (int, error) {
+	if position >= len(data) {
+		return 0, errors.New("Unexpected end of bencoded data")
+	}
+
+	switch data[position] {
+	case 'i':
+		end := bytes.IndexByte(data[position:], 'e')
+		if end < 2 {
+			return 0, errors.New("Invalid bencoded integer")
+		}
+		_, parseErr := strconv.ParseInt(string(data[position+1:position+end]), 10, 64)
+		if parseErr != nil {
+			return 0, errors.New("Invalid bencoded integer")
+		}
+		return position + end + 1, nil
+	case 'l', 'd':
+		position++
+		for position < len(data) && data[position] != 'e' {
+			end, err := scanBencodeValue(data, position)
+			if err != nil {
+				return 0, err
+			}
+			position = end
+		}
+		if position >= len(data) {
+			return 0, errors.New("Unterminated bencoded list or dictionary")
+		}
+		return position + 1, nil
+	default:
+		colon := bytes.IndexByte(data[position:], ':')
+		if colon < 1 {
+			return 0, errors.New("Invalid bencoded string")
+		}
+		length, parseErr := strconv.Atoi(string(data[position:position+colon]))
+		if parseErr != nil || length < 0 {
+			return 0, errors.New("Invalid bencoded string length")
+		}
+		// Compare against the bytes left so huge lengths can not overflow
+		start := position + colon + 1
+		if length > len(data) - start {
+			return 0, errors.New("Bencoded string exceeds data length")
+		}
+		return start + length, nil
+	}
+}
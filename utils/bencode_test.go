@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestSplitBencodeValue(t *testing.T) {
+	value, rest, err := SplitBencodeValue([]byte("d8:msg_typei1e5:piecei0eexyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "d8:msg_typei1e5:piecei0ee" || string(rest) != "xyz" {
+		t.Errorf("Unexpected split: %q and %q", value, rest)
+	}
+}
+
+func TestOversizedStringLength(t *testing.T) {
+	// Lengths past the end of the data, including ones that would overflow
+	// when added to the position, are rejected instead of panicking
+	for _, data := range []string{
+		"5:abc",
+		"9223372036854775807:abc",
+		"d3:key9223372036854775807:abce",
+		"l9223372036854775800:e",
+	} {
+		if _, _, err := SplitBencodeValue([]byte(data)); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+
+	if _, err := DecodeRawDict([]byte("d9223372036854775807:ae")); err == nil {
+		t.Error("Expected a dictionary key with an oversized length to be rejected")
+	}
+}
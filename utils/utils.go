@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"io"
 	"errors"
 	"crypto/rand"
@@ -35,6 +36,11 @@ func ParseBencodeResponse(body io.ReadCloser) (map[string]interface{}, error) {
 	return nil, errors.New("Bencode type mismatch")
 }
 
+// Decode a bencoded dictionary, eg: from a message sent by a peer
+func DecodeBencodeDict(data []byte) (map[string]interface{}, error) {
+	return ParseBencodeResponse(io.NopCloser(bytes.NewReader(data)))
+}
+
 type PeerCount struct {
 	Mu		*sync.Mutex
 	Count	int
@@ -61,3 +67,54 @@ func (pc *PeerCount) GetCount() int {
 	pc.Mu.Unlock()
 	return currentCount
 }
+
+type TransferStats struct {
+	Mu			*sync.Mutex
+	Uploaded	int64
+	Downloaded	int64
+	Left		int64
+}
+
+// Create transfer stats for a torrent with the provided bytes left
+func NewTransferStats(left int64) *TransferStats {
+	return &TransferStats{
+		Mu: &sync.Mutex{},
+		Left: left,
+	}
+}
+
+// Safely add to the uploaded bytes count
+func (ts *TransferStats) AddUploaded(n int) {
+	ts.Mu.Lock()
+	ts.Uploaded += int64(n)
+	ts.Mu.Unlock()
+}
+
+// Safely add to the downloaded bytes count
+func (ts *TransferStats) AddDownloaded(n int) {
+	ts.Mu.Lock()
+	ts.Downloaded += int64(n)
+	ts.Mu.Unlock()
+}
+
+// Safely subtract from the bytes left to download
+func (ts *TransferStats) SubtractLeft(n int) {
+	ts.Mu.Lock()
+	ts.Left -= int64(n)
+	ts.Mu.Unlock()
+}
+
+// Safely restore the uploaded and downloaded counts, eg: from resume data
+func (ts *TransferStats) SetTransferred(uploaded int64, downloaded int64) {
+	ts.Mu.Lock()
+	ts.Uploaded = uploaded
+	ts.Downloaded = downloaded
+	ts.Mu.Unlock()
+}
+
+// Safely get the uploaded, downloaded and left counts
+func (ts *TransferStats) Get() (int64, int64, int64) {
+	ts.Mu.Lock()
+	defer ts.Mu.Unlock()
+	return ts.Uploaded, ts.Downloaded, ts.Left
+}
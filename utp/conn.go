@@ -0,0 +1,558 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Bytes buffered for reading, also the largest window we advertise
+const RECEIVE_BUFFER_SIZE = 1024 * 1024
+
+// Bytes buffered by Write before it blocks until they are sent
+const SEND_BUFFER_SIZE = 256 * 1024
+
+// Retransmission timeouts, doubled each time a packet times out again
+const INITIAL_TIMEOUT = time.Second
+const MIN_TIMEOUT = 500 * time.Millisecond
+const MAX_TIMEOUT = 30 * time.Second
+
+// The connection fails after this many timeouts in a row
+const MAX_RETRANSMISSIONS = 5
+
+// A packet is resent without waiting for its timeout once this many
+// packets after it were acked
+const DUPLICATE_ACK_THRESHOLD = 3
+
+// Packets received this far ahead of the next expected one are dropped
+const MAX_OUT_OF_ORDER = 1024
+
+// An idle connection sends a State packet this often to keep NAT
+// mappings alive
+const KEEPALIVE_INTERVAL = 29 * time.Second
+
+// The connection fails when nothing was received for this long, peers
+// send keepalives more often
+const IDLE_TIMEOUT = 2 * time.Minute
+
+// A closed connection is dropped after this long even if its data and
+// Fin packet were never acked
+const LINGER_TIMEOUT = 30 * time.Second
+
+var ErrConnectionReset = errors.New("uTP connection reset by peer")
+var ErrConnectionTimeout = errors.New("uTP connection timed out")
+
+const (
+	STATE_SYN_SENT = iota
+	STATE_CONNECTED
+	STATE_CLOSED
+)
+
+// A packet sent but not acked yet
+type outgoingPacket struct {
+	packet		packet
+	sentAt		time.Time
+	sent		int  // Number of times it was sent
+	needResend	bool // Presumed lost, not counted as in flight
+}
+
+// A uTP connection (BEP 29) to a peer, a reliable ordered stream over UDP
+// with LEDBAT congestion control, usable like a TCP connection
+type Conn struct {
+	mu				*sync.Mutex
+	cond			*sync.Cond
+	socket			*Socket
+	remote			*net.UDPAddr
+	recvId			uint16
+	sendId			uint16
+	state			int
+	err				error
+	closed			bool
+	closedAt		time.Time
+	readDeadline	time.Time
+	writeDeadline	time.Time
+
+	// Sending
+	seqNr			uint16
+	sendBuffer		[]byte
+	inFlight		[]*outgoingPacket
+	flightBytes		int
+	peerWindow		int
+	congestion		*ledbat
+	rtt				time.Duration
+	rttVar			time.Duration
+	timeout			time.Duration
+	retransmissions	int
+	lastAckNr		uint16
+	duplicateAcks	int
+	finSent			bool
+	lastSent		time.Time
+
+	// Receiving
+	ackNr			uint16
+	recvBuffer		[]byte
+	outOfOrder		map[uint16]packet
+	outOfOrderBytes	int
+	eof				bool
+	replyMicro		uint32
+	lastReceived	time.Time
+}
+
+func newConn(socket *Socket, remote *net.UDPAddr) *Conn {
+	mu := &sync.Mutex{}
+	return &Conn{
+		mu: mu,
+		cond: sync.NewCond(mu),
+		socket: socket,
+		remote: remote,
+		peerWindow: RECEIVE_BUFFER_SIZE,
+		congestion: newLedbat(),
+		timeout: INITIAL_TIMEOUT,
+		outOfOrder: map[uint16]packet{},
+	}
+}
+
+// Read data from the connection, returns io.EOF once the peer closed it
+// and all its data was read
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.recvBuffer) == 0 {
+		if c.closed {
+			return 0, net.ErrClosed
+		} else if c.eof {
+			return 0, io.EOF
+		} else if c.err != nil {
+			return 0, c.err
+		}
+		waitErr := c.wait(c.readDeadline)
+		if waitErr != nil {
+			return 0, waitErr
+		}
+	}
+
+	// Let the peer know it can send again if our window was closed
+	windowClosed := c.receiveWindow() < PACKET_SIZE
+	n := copy(b, c.recvBuffer)
+	c.recvBuffer = c.recvBuffer[n:]
+	if windowClosed && c.receiveWindow() >= PACKET_SIZE {
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write data to the connection, it is sent as the congestion window and
+// the peer's receive window allow. Blocks while the send buffer is full
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.closed {
+			return written, net.ErrClosed
+		} else if c.err != nil {
+			return written, c.err
+		}
+
+		space := SEND_BUFFER_SIZE - len(c.sendBuffer)
+		if space <= 0 {
+			waitErr := c.wait(c.writeDeadline)
+			if waitErr != nil {
+				return written, waitErr
+			}
+			continue
+		}
+
+		n := min(space, len(b) - written)
+		c.sendBuffer = append(c.sendBuffer, b[written:written + n]...)
+		written += n
+		c.flush()
+	}
+	return written, nil
+}
+
+// Close the connection, data already written is still sent before the
+// Fin packet. Pending and later reads and writes fail
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	c.flush()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// Wait for the connection's state to change, or for the deadline to pass.
+// Must be called with the lock held
+func (c *Conn) wait(deadline time.Time) error {
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.AfterFunc(remaining, func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	c.cond.Wait()
+	return nil
+}
+
+// Fail the connection, waking up pending reads and writes
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = STATE_CLOSED
+	c.cond.Broadcast()
+}
+
+// Bytes we can still receive
+func (c *Conn) receiveWindow() int {
+	return max(RECEIVE_BUFFER_SIZE - len(c.recvBuffer) - c.outOfOrderBytes, 0)
+}
+
+// Check if a packet with the payload size fits in the congestion window
+// and the peer's receive window. A single packet is always allowed when
+// none are in flight, so a closed window is probed
+func (c *Conn) canSend(size int) bool {
+	window := min(c.congestion.Window, c.peerWindow)
+	return c.flightBytes == 0 || c.flightBytes + size <= window
+}
+
+// Send the packets presumed lost, then new packets from the send buffer,
+// as far as the windows allow. The Fin packet follows the last data
+func (c *Conn) flush() {
+	if c.state != STATE_CONNECTED {
+		return
+	}
+
+	for _, outgoing := range c.inFlight {
+		if !outgoing.needResend {
+			continue
+		} else if !c.canSend(len(outgoing.packet.Payload)) {
+			return
+		}
+		outgoing.needResend = false
+		c.flightBytes += len(outgoing.packet.Payload)
+		c.transmit(outgoing)
+	}
+
+	for len(c.sendBuffer) > 0 && c.canSend(min(len(c.sendBuffer), MAX_PAYLOAD)) {
+		size := min(len(c.sendBuffer), MAX_PAYLOAD)
+		payload := append([]byte{}, c.sendBuffer[:size]...)
+		c.sendBuffer = c.sendBuffer[size:]
+		c.sendNew(ST_DATA, payload)
+		c.cond.Broadcast()
+	}
+
+	if c.closed && !c.finSent && len(c.sendBuffer) == 0 {
+		c.finSent = true
+		c.sendNew(ST_FIN, nil)
+	}
+}
+
+// Send a new packet, consuming a sequence number
+func (c *Conn) sendNew(packetType int, payload []byte) {
+	outgoing := &outgoingPacket{
+		packet: packet{Type: packetType, SeqNr: c.seqNr, Payload: payload},
+	}
+	c.seqNr++
+	c.inFlight = append(c.inFlight, outgoing)
+	c.flightBytes += len(payload)
+	c.transmit(outgoing)
+}
+
+// Send or resend a packet, with the current acks and timestamps
+func (c *Conn) transmit(outgoing *outgoingPacket) {
+	now := time.Now()
+	outgoing.sentAt = now
+	outgoing.sent++
+	c.send(&outgoing.packet, now)
+}
+
+// Fill in the header fields describing our side of the connection and
+// send the packet. Syn packets carry the ID the peer will send with
+func (c *Conn) send(p *packet, now time.Time) {
+	p.ConnectionId = c.sendId
+	if p.Type == ST_SYN {
+		p.ConnectionId = c.recvId
+	}
+	p.Timestamp = microseconds(now)
+	p.TimestampDiff = c.replyMicro
+	p.WindowSize = uint32(c.receiveWindow())
+	p.AckNr = c.ackNr
+	c.lastSent = now
+	c.socket.send(p.encode(), c.remote)
+}
+
+// Ack the packets received so far, with a selective ack of the packets
+// received after a gap
+func (c *Conn) sendState() {
+	state := &packet{Type: ST_STATE, SeqNr: c.seqNr}
+	if len(c.outOfOrder) > 0 {
+		state.SelectiveAck = make([]byte, MAX_SELECTIVE_ACK_BYTES)
+		length := 0
+		for i := 0; i < MAX_SELECTIVE_ACK_BYTES * 8; i++ {
+			if _, found := c.outOfOrder[c.ackNr + 2 + uint16(i)]; found {
+				state.SelectiveAck[i / 8] |= 1 << (i % 8)
+				length = i / 8 + 1
+			}
+		}
+		// The bitmask length must be a multiple of 4 bytes
+		state.SelectiveAck = state.SelectiveAck[:(length + 3) / 4 * 4]
+	}
+	c.send(state, time.Now())
+}
+
+// Handle a packet the peer sent on this connection
+func (c *Conn) handlePacket(p packet, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == STATE_CLOSED {
+		return
+	}
+	c.lastReceived = now
+	c.replyMicro = microseconds(now) - p.Timestamp
+	c.peerWindow = int(p.WindowSize)
+
+	switch p.Type {
+	case ST_RESET:
+		c.fail(ErrConnectionReset)
+		return
+	case ST_SYN:
+		// Our State packet acking the Syn was lost
+		c.sendState()
+		return
+	}
+
+	// The first packet the peer sends back completes the connection, the
+	// sequence numbers of its data continue after it
+	if c.state == STATE_SYN_SENT {
+		c.ackNr = p.SeqNr - 1
+		c.state = STATE_CONNECTED
+		c.cond.Broadcast()
+	}
+
+	c.handleAck(p, now)
+	if p.Type == ST_DATA || p.Type == ST_FIN {
+		c.receive(p)
+	}
+	c.flush()
+}
+
+// Remove the packets acked by the peer from the ones in flight, resending
+// the ones it reports as lost, and grow or shrink the congestion window
+func (c *Conn) handleAck(p packet, now time.Time) {
+	// Ignore acks of packets we did not send yet
+	if seqLess(c.seqNr - 1, p.AckNr) {
+		return
+	}
+
+	bytesAcked := 0
+	ackPacket := func(outgoing *outgoingPacket) {
+		bytesAcked += len(outgoing.packet.Payload)
+		if !outgoing.needResend {
+			c.flightBytes -= len(outgoing.packet.Payload)
+		}
+		if outgoing.sent == 1 {
+			c.updateRTT(now.Sub(outgoing.sentAt))
+		}
+	}
+
+	for len(c.inFlight) > 0 && !seqLess(p.AckNr, c.inFlight[0].packet.SeqNr) {
+		ackPacket(c.inFlight[0])
+		c.inFlight = c.inFlight[1:]
+	}
+
+	// Packets after the first one missing that the peer received
+	selectivelyAcked := 0
+	if len(p.SelectiveAck) > 0 {
+		remaining := []*outgoingPacket{}
+		for _, outgoing := range c.inFlight {
+			i := int(outgoing.packet.SeqNr - p.AckNr - 2)
+			if i >= 0 && i < len(p.SelectiveAck) * 8 && p.SelectiveAck[i / 8] & (1 << (i % 8)) != 0 {
+				ackPacket(outgoing)
+				selectivelyAcked++
+				continue
+			}
+			remaining = append(remaining, outgoing)
+		}
+		c.inFlight = remaining
+	}
+
+	// Count the packets the peer received after the next one we are
+	// waiting for it to ack, through duplicate and selective acks
+	if p.AckNr != c.lastAckNr {
+		c.lastAckNr = p.AckNr
+		c.duplicateAcks = selectivelyAcked
+	} else if p.Type == ST_STATE && len(c.inFlight) > 0 {
+		c.duplicateAcks += max(selectivelyAcked, 1)
+	}
+
+	// The next packet is presumed lost once enough packets after it
+	// arrived, it is resent right away
+	if len(c.inFlight) > 0 && c.duplicateAcks >= DUPLICATE_ACK_THRESHOLD {
+		lost := c.inFlight[0]
+		if lost.packet.SeqNr == p.AckNr + 1 && lost.sent == 1 && !lost.needResend {
+			c.congestion.onLoss()
+			c.flightBytes -= len(lost.packet.Payload)
+			lost.needResend = true
+		}
+	}
+
+	if bytesAcked > 0 {
+		c.retransmissions = 0
+		if p.TimestampDiff != 0 {
+			c.congestion.onAck(bytesAcked, p.TimestampDiff, now)
+		}
+		c.cond.Broadcast()
+	}
+}
+
+// Update the round trip time estimate and the retransmission timeout
+// derived from it
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		c.rttVar += (max(delta, -delta) - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.timeout = max(c.rtt + 4 * c.rttVar, MIN_TIMEOUT)
+}
+
+// Buffer the payload of a Data or Fin packet, delivering it in order
+// and acking it
+func (c *Conn) receive(p packet) {
+	if p.SeqNr == c.ackNr + 1 {
+		if len(c.recvBuffer) + len(p.Payload) > RECEIVE_BUFFER_SIZE {
+			// No room for it, the peer will resend it
+			return
+		}
+		c.deliver(p)
+		for {
+			next, found := c.outOfOrder[c.ackNr + 1]
+			if !found {
+				break
+			}
+			delete(c.outOfOrder, c.ackNr + 1)
+			c.outOfOrderBytes -= len(next.Payload)
+			c.deliver(next)
+		}
+	} else if seqLess(c.ackNr, p.SeqNr) && p.SeqNr - c.ackNr < MAX_OUT_OF_ORDER {
+		if _, found := c.outOfOrder[p.SeqNr]; !found && len(p.Payload) <= c.receiveWindow() {
+			p.Payload = append([]byte{}, p.Payload...)
+			c.outOfOrder[p.SeqNr] = p
+			c.outOfOrderBytes += len(p.Payload)
+		}
+	}
+
+	// Duplicates are acked again, our previous ack may have been lost
+	c.sendState()
+}
+
+// Append the payload of the next packet in sequence to the read buffer
+func (c *Conn) deliver(p packet) {
+	c.ackNr = p.SeqNr
+	if c.eof {
+		return
+	}
+	c.recvBuffer = append(c.recvBuffer, p.Payload...)
+	if p.Type == ST_FIN {
+		c.eof = true
+	}
+	c.cond.Broadcast()
+}
+
+// Resend packets that timed out and keep the connection alive, called
+// periodically by the socket. Returns true once the connection is done
+// and can be removed
+func (c *Conn) tick(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == STATE_CLOSED {
+		return true
+	} else if c.closed && (c.finSent && len(c.inFlight) == 0 || now.Sub(c.closedAt) > LINGER_TIMEOUT) {
+		c.fail(net.ErrClosed)
+		return true
+	} else if c.state == STATE_CONNECTED && now.Sub(c.lastReceived) > IDLE_TIMEOUT {
+		c.fail(ErrConnectionTimeout)
+		return true
+	}
+
+	if len(c.inFlight) > 0 && now.Sub(c.inFlight[0].sentAt) > c.timeout {
+		c.retransmissions++
+		if c.retransmissions > MAX_RETRANSMISSIONS {
+			c.fail(ErrConnectionTimeout)
+			return true
+		}
+
+		// Everything in flight is presumed lost, the window restarts
+		// from a single packet
+		c.timeout = min(c.timeout * 2, MAX_TIMEOUT)
+		c.congestion.onTimeout()
+		for _, outgoing := range c.inFlight {
+			outgoing.needResend = true
+		}
+		c.flightBytes = 0
+		if c.state == STATE_SYN_SENT {
+			c.inFlight[0].needResend = false
+			c.transmit(c.inFlight[0])
+		}
+		c.flush()
+	} else if c.state == STATE_CONNECTED && now.Sub(c.lastSent) > KEEPALIVE_INTERVAL {
+		c.sendState()
+	}
+	return false
+}
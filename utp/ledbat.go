@@ -0,0 +1,88 @@
+package utp
+
+import (
+	"time"
+)
+
+// LEDBAT aims to add at most this much queuing delay on the path
+const TARGET_DELAY = 100 * time.Millisecond
+
+// Largest increase of the window in bytes per round trip
+const MAX_WINDOW_INCREASE = 3000
+
+const INITIAL_WINDOW = 4 * PACKET_SIZE
+const MIN_WINDOW = PACKET_SIZE
+const MAX_WINDOW = RECEIVE_BUFFER_SIZE
+
+// The base delay is the lowest delay seen in the last couple of minutes,
+// tracked as the minimum of each minute
+const BASE_DELAY_INTERVAL = time.Minute
+const BASE_DELAY_HISTORY = 2
+
+// LEDBAT congestion control: the window grows while the one way delay
+// measured by the other side stays under the target, and shrinks once
+// our packets start queuing up on the path, yielding to other traffic
+type ledbat struct {
+	Window			int // Bytes allowed in flight
+	baseDelays		[BASE_DELAY_HISTORY]uint32
+	baseDelayIndex	int
+	baseDelayStart	time.Time
+	hasBaseDelay	bool
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{Window: INITIAL_WINDOW}
+}
+
+// Record a delay sample, updating the base delay it is compared to
+func (l *ledbat) addDelaySample(delay uint32, now time.Time) {
+	if !l.hasBaseDelay {
+		for i := range l.baseDelays {
+			l.baseDelays[i] = delay
+		}
+		l.baseDelayStart = now
+		l.hasBaseDelay = true
+		return
+	}
+
+	if now.Sub(l.baseDelayStart) >= BASE_DELAY_INTERVAL {
+		l.baseDelayIndex = (l.baseDelayIndex + 1) % BASE_DELAY_HISTORY
+		l.baseDelays[l.baseDelayIndex] = delay
+		l.baseDelayStart = now
+	} else if delay < l.baseDelays[l.baseDelayIndex] {
+		l.baseDelays[l.baseDelayIndex] = delay
+	}
+}
+
+// Get the lowest delay seen recently, the delay of an empty path
+func (l *ledbat) baseDelay() uint32 {
+	base := l.baseDelays[0]
+	for _, delay := range l.baseDelays[1:] {
+		base = min(base, delay)
+	}
+	return base
+}
+
+// Adjust the window once bytes were acked, the delay is the one way delay
+// of our packets measured by the other side
+func (l *ledbat) onAck(bytesAcked int, delay uint32, now time.Time) {
+	l.addDelaySample(delay, now)
+	ourDelay := time.Duration(delay - l.baseDelay()) * time.Microsecond
+
+	delayFactor := float64(TARGET_DELAY - ourDelay) / float64(TARGET_DELAY)
+	delayFactor = max(min(delayFactor, 1), -1)
+	windowFactor := float64(min(bytesAcked, l.Window)) / float64(l.Window)
+	l.Window += int(MAX_WINDOW_INCREASE * delayFactor * windowFactor)
+	l.Window = max(min(l.Window, MAX_WINDOW), MIN_WINDOW)
+}
+
+// Halve the window when a packet was lost
+func (l *ledbat) onLoss() {
+	l.Window = max(l.Window / 2, MIN_WINDOW)
+}
+
+// Shrink the window to a single packet when the other side stopped
+// acking our packets
+func (l *ledbat) onTimeout() {
+	l.Window = MIN_WINDOW
+}
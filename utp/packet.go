@@ -0,0 +1,118 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Version of the uTP protocol (BEP 29)
+const VERSION = 1
+
+// Packet types
+const (
+	ST_DATA = 0
+	ST_FIN = 1
+	ST_STATE = 2
+	ST_RESET = 3
+	ST_SYN = 4
+)
+
+const HEADER_LENGTH = 20
+
+// Extension carrying a bitmask of the packets received after a gap
+const EXTENSION_SELECTIVE_ACK = 1
+
+// Packets are kept small enough to fit in a single UDP datagram on
+// common links without fragmentation
+const PACKET_SIZE = 1400
+const MAX_PAYLOAD = PACKET_SIZE - HEADER_LENGTH
+
+// Selective acks cover at most this many packets after the gap
+const MAX_SELECTIVE_ACK_BYTES = 8
+
+var ErrInvalidPacket = errors.New("Invalid uTP packet")
+
+// A uTP packet, the header followed by its extensions and payload
+type packet struct {
+	Type			int
+	ConnectionId	uint16
+	Timestamp		uint32 // Microseconds, when the packet was sent
+	TimestampDiff	uint32 // Microseconds, delay of the last packet received
+	WindowSize		uint32 // Bytes the sender can still receive
+	SeqNr			uint16
+	AckNr			uint16
+	SelectiveAck	[]byte
+	Payload			[]byte
+}
+
+// Encode the packet to be sent in a datagram
+func (p *packet) encode() []byte {
+	b := make([]byte, HEADER_LENGTH, HEADER_LENGTH + 2 + len(p.SelectiveAck) + len(p.Payload))
+	b[0] = byte(p.Type << 4 | VERSION)
+	if len(p.SelectiveAck) > 0 {
+		b[1] = EXTENSION_SELECTIVE_ACK
+	}
+	binary.BigEndian.PutUint16(b[2:], p.ConnectionId)
+	binary.BigEndian.PutUint32(b[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(b[8:], p.TimestampDiff)
+	binary.BigEndian.PutUint32(b[12:], p.WindowSize)
+	binary.BigEndian.PutUint16(b[16:], p.SeqNr)
+	binary.BigEndian.PutUint16(b[18:], p.AckNr)
+	if len(p.SelectiveAck) > 0 {
+		b = append(b, 0, byte(len(p.SelectiveAck)))
+		b = append(b, p.SelectiveAck...)
+	}
+	return append(b, p.Payload...)
+}
+
+// Decode a datagram into a packet, datagrams that are not uTP packets,
+// like the DHT's messages sharing the socket, are rejected
+func decodePacket(b []byte) (packet, error) {
+	if len(b) < HEADER_LENGTH || b[0] & 0x0f != VERSION || int(b[0] >> 4) > ST_SYN {
+		return packet{}, ErrInvalidPacket
+	}
+
+	p := packet{
+		Type: int(b[0] >> 4),
+		ConnectionId: binary.BigEndian.Uint16(b[2:]),
+		Timestamp: binary.BigEndian.Uint32(b[4:]),
+		TimestampDiff: binary.BigEndian.Uint32(b[8:]),
+		WindowSize: binary.BigEndian.Uint32(b[12:]),
+		SeqNr: binary.BigEndian.Uint16(b[16:]),
+		AckNr: binary.BigEndian.Uint16(b[18:]),
+	}
+
+	// Extensions form a linked list, each naming the type of the next one
+	extension := int(b[1])
+	offset := HEADER_LENGTH
+	for extension != 0 {
+		if offset + 2 > len(b) {
+			return packet{}, ErrInvalidPacket
+		}
+		next := int(b[offset])
+		length := int(b[offset + 1])
+		offset += 2
+		if offset + length > len(b) {
+			return packet{}, ErrInvalidPacket
+		}
+		if extension == EXTENSION_SELECTIVE_ACK {
+			p.SelectiveAck = b[offset:offset + length]
+		}
+		offset += length
+		extension = next
+	}
+
+	p.Payload = b[offset:]
+	return p, nil
+}
+
+// Compare sequence numbers, which wrap around
+func seqLess(a uint16, b uint16) bool {
+	return int16(a - b) < 0
+}
+
+// Current time in microseconds, as used in the packet timestamps
+func microseconds(now time.Time) uint32 {
+	return uint32(now.UnixMicro())
+}
@@ -0,0 +1,354 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Time allowed for the peer to answer our Syn packet when dialing
+const CONNECT_TIMEOUT = 10 * time.Second
+
+// Incoming connections waiting to be accepted, more are reset
+const ACCEPT_BACKLOG = 16
+
+// Datagrams that are not uTP packets waiting to be read, more are dropped
+const PACKET_BACKLOG = 64
+
+// Connections are checked for timeouts this often
+const TICK_INTERVAL = 50 * time.Millisecond
+
+const MAX_DATAGRAM_SIZE = 65535
+
+// A datagram that is not a uTP packet
+type datagram struct {
+	Data	[]byte
+	Addr	*net.UDPAddr
+}
+
+type connKey struct {
+	addr	string
+	id		uint16
+}
+
+// A UDP socket carrying uTP connections, both the ones we dial and the
+// ones peers initiate with us. Other datagrams received on the socket are
+// passed on, so the DHT can share the port
+type Socket struct {
+	mu			*sync.Mutex
+	conn		*net.UDPConn
+	conns		map[connKey]*Conn
+	accepted	chan *Conn
+	datagrams	chan datagram
+	closed		chan struct{}
+	stopped		chan struct{}
+	ticked		chan struct{}
+}
+
+// Open a uTP socket on the UDP port, for both IPv4 and IPv6 peers when
+// the system supports it
+func Listen(port int) (*Socket, error) {
+	conn, listenErr := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if listenErr != nil {
+		return nil, listenErr
+	}
+
+	s := &Socket{
+		mu: &sync.Mutex{},
+		conn: conn,
+		conns: map[connKey]*Conn{},
+		accepted: make(chan *Conn, ACCEPT_BACKLOG),
+		datagrams: make(chan datagram, PACKET_BACKLOG),
+		closed: make(chan struct{}),
+		stopped: make(chan struct{}),
+		ticked: make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s, nil
+}
+
+// Get the local address of the socket
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Get the UDP port of the socket
+func (s *Socket) Port() int {
+	return s.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Open a uTP connection to the address, waiting up to the timeout for
+// the peer to answer, or CONNECT_TIMEOUT if it is 0
+func (s *Socket) Dial(address string, timeout time.Duration) (*Conn, error) {
+	remote, resolveErr := net.ResolveUDPAddr("udp", address)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	if timeout == 0 {
+		timeout = CONNECT_TIMEOUT
+	}
+
+	c := newConn(s, remote)
+	c.state = STATE_SYN_SENT
+	c.seqNr = 1
+	registerErr := s.register(c)
+	if registerErr != nil {
+		return nil, registerErr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendNew(ST_SYN, nil)
+
+	deadline := time.Now().Add(timeout)
+	for c.state == STATE_SYN_SENT {
+		waitErr := c.wait(deadline)
+		if waitErr != nil {
+			c.fail(ErrConnectionTimeout)
+		}
+	}
+	if c.state != STATE_CONNECTED {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// Register a connection we are dialing under a connection ID that is not
+// in use for the address yet
+func (s *Socket) register(c *Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	idBytes := make([]byte, 2)
+	for {
+		rand.Read(idBytes)
+		c.recvId = binary.BigEndian.Uint16(idBytes)
+		c.sendId = c.recvId + 1
+		key := connKey{addr: c.remote.String(), id: c.recvId}
+		if _, found := s.conns[key]; !found {
+			s.conns[key] = c
+			return nil
+		}
+	}
+}
+
+// Wait for a peer to open a uTP connection with us
+func (s *Socket) Accept() (*Conn, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close the socket along with all its connections
+func (s *Socket) Close() {
+	close(s.closed)
+	s.conn.Close()
+	<-s.stopped
+	<-s.ticked
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.mu.Lock()
+		c.fail(net.ErrClosed)
+		c.mu.Unlock()
+	}
+	s.conns = map[connKey]*Conn{}
+}
+
+// Send a datagram, failures are handled like lost packets
+func (s *Socket) send(b []byte, addr *net.UDPAddr) {
+	s.conn.WriteToUDP(b, addr)
+}
+
+// Read datagrams until the socket is closed, handing the uTP packets to
+// their connections
+func (s *Socket) readLoop() {
+	defer close(s.stopped)
+
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, readErr := s.conn.ReadFromUDP(buffer)
+		if readErr != nil {
+			if errors.Is(readErr, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		now := time.Now()
+
+		p, decodeErr := decodePacket(buffer[:n])
+		if decodeErr != nil {
+			select {
+			case s.datagrams <- datagram{Data: append([]byte{}, buffer[:n]...), Addr: addr}:
+			default:
+			}
+			continue
+		}
+
+		c, found := s.findConn(p, addr)
+
+		if found {
+			c.handlePacket(p, now)
+		} else if p.Type == ST_SYN {
+			s.handleSyn(p, addr, now)
+		} else if p.Type != ST_RESET {
+			s.send((&packet{Type: ST_RESET, ConnectionId: p.ConnectionId, AckNr: p.SeqNr}).encode(), addr)
+		}
+	}
+}
+
+// Find the connection the packet is for
+func (s *Socket) findConn(p packet, addr *net.UDPAddr) (*Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Syn packets carry the ID the peer receives with, the connection
+	// receives with the next one
+	switch p.Type {
+	case ST_SYN:
+		c, found := s.conns[connKey{addr: addr.String(), id: p.ConnectionId + 1}]
+		return c, found
+	case ST_RESET:
+		// Resets for connections the peer does not know carry the ID we
+		// send with, which is next to the ID we receive with
+		for _, id := range []uint16{p.ConnectionId, p.ConnectionId + 1, p.ConnectionId - 1} {
+			c, found := s.conns[connKey{addr: addr.String(), id: id}]
+			if found && (id == p.ConnectionId || c.sendId == p.ConnectionId) {
+				return c, true
+			}
+		}
+		return nil, false
+	}
+	c, found := s.conns[connKey{addr: addr.String(), id: p.ConnectionId}]
+	return c, found
+}
+
+// Accept a connection the peer initiated with its Syn packet, unless too
+// many connections are waiting to be accepted
+func (s *Socket) handleSyn(syn packet, addr *net.UDPAddr, now time.Time) {
+	c := newConn(s, addr)
+	c.recvId = syn.ConnectionId + 1
+	c.sendId = syn.ConnectionId
+	c.state = STATE_CONNECTED
+	c.ackNr = syn.SeqNr
+	c.lastReceived = now
+	c.peerWindow = int(syn.WindowSize)
+	c.replyMicro = microseconds(now) - syn.Timestamp
+
+	seqBytes := make([]byte, 2)
+	rand.Read(seqBytes)
+	c.seqNr = binary.BigEndian.Uint16(seqBytes)
+	c.lastAckNr = c.seqNr - 1
+
+	select {
+	case s.accepted <- c:
+	default:
+		s.send((&packet{Type: ST_RESET, ConnectionId: syn.ConnectionId, AckNr: syn.SeqNr}).encode(), addr)
+		return
+	}
+
+	s.mu.Lock()
+	s.conns[connKey{addr: addr.String(), id: c.recvId}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.sendState()
+	c.mu.Unlock()
+}
+
+// Check the connections for timeouts periodically, removing the ones
+// that are done
+func (s *Socket) tickLoop() {
+	defer close(s.ticked)
+
+	ticker := time.NewTicker(TICK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make(map[connKey]*Conn, len(s.conns))
+			for key, c := range s.conns {
+				conns[key] = c
+			}
+			s.mu.Unlock()
+
+			for key, c := range conns {
+				if c.tick(now) {
+					s.mu.Lock()
+					delete(s.conns, key)
+					s.mu.Unlock()
+				}
+			}
+		}
+	}
+}
+
+// Get a view of the socket for reading and writing the datagrams that are
+// not uTP packets, closing it leaves the socket open
+func (s *Socket) PacketConn() net.PacketConn {
+	return &packetConn{socket: s, closed: make(chan struct{}), once: &sync.Once{}}
+}
+
+// The datagrams of a socket that are not uTP packets
+type packetConn struct {
+	socket	*Socket
+	closed	chan struct{}
+	once	*sync.Once
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-pc.socket.datagrams:
+		return copy(b, d.Data), d.Addr, nil
+	case <-pc.closed:
+		return 0, nil, net.ErrClosed
+	case <-pc.socket.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return pc.socket.conn.WriteTo(b, addr)
+}
+
+func (pc *packetConn) Close() error {
+	pc.once.Do(func() {
+		close(pc.closed)
+	})
+	return nil
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return pc.socket.Addr()
+}
+
+var ErrDeadlineUnsupported = errors.New("Deadlines are not supported on a uTP socket's datagrams")
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	return ErrDeadlineUnsupported
+}
+
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	return ErrDeadlineUnsupported
+}
+
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	return ErrDeadlineUnsupported
+}
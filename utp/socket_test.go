@@ -0,0 +1,173 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Open a uTP socket on a free port
+func newTestSocket(t *testing.T) *Socket {
+	s, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func socketAddress(s *Socket) string {
+	return "127.0.0.1:" + strconv.Itoa(s.Port())
+}
+
+// Dial the listening socket from the dialing socket, returning both ends
+// of the connection
+func newTestConns(t *testing.T, dialing *Socket, listening *Socket, address string) (*Conn, *Conn) {
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, _ := listening.Accept()
+		accepted <- c
+	}()
+
+	dialed, err := dialing.Dial(address, 5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-accepted:
+		return dialed, c
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be accepted")
+	}
+	return nil, nil
+}
+
+func TestDialAccept(t *testing.T) {
+	a := newTestSocket(t)
+	b := newTestSocket(t)
+	dialed, accepted := newTestConns(t, a, b, socketAddress(b))
+
+	if port := dialed.RemoteAddr().(*net.UDPAddr).Port; port != b.Port() {
+		t.Errorf("Expected the dialed connection to port %d, got %d", b.Port(), port)
+	}
+	if port := accepted.RemoteAddr().(*net.UDPAddr).Port; port != a.Port() {
+		t.Errorf("Expected the accepted connection from port %d, got %d", a.Port(), port)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	a := newTestSocket(t)
+	b := newTestSocket(t)
+	dialed, accepted := newTestConns(t, a, b, socketAddress(b))
+
+	// More than the send buffer, so the congestion and receive windows are
+	// exercised
+	data := make([]byte, 4 * SEND_BUFFER_SIZE + 123)
+	rand.Read(data)
+	go func() {
+		dialed.Write(data)
+		dialed.Close()
+	}()
+
+	// The data arrives in order, followed by EOF once the dialer closed
+	received, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("Expected %d bytes to be received intact, got %d", len(data), len(received))
+	}
+
+	// The other direction still works until it is closed
+	if _, err := accepted.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected reads after closing to fail, got %v", err)
+	}
+	if _, err := accepted.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected writes after closing to fail, got %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a := newTestSocket(t)
+	b := newTestSocket(t)
+	dialed, _ := newTestConns(t, a, b, socketAddress(b))
+
+	dialed.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := dialed.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the read to time out, got %v", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	a := newTestSocket(t)
+	silent, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer silent.Close()
+
+	start := time.Now()
+	_, err := a.Dial(silent.LocalAddr().String(), 300 * time.Millisecond)
+	if err != ErrConnectionTimeout {
+		t.Errorf("Expected the dial to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Errorf("Expected to give up after the timeout, took %v", elapsed)
+	}
+}
+
+func TestDialIPv6(t *testing.T) {
+	probe, probeErr := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if probeErr != nil {
+		t.Skip("IPv6 loopback is not available")
+	}
+	probe.Close()
+
+	a := newTestSocket(t)
+	b := newTestSocket(t)
+	dialed, accepted := newTestConns(t, a, b, "[::1]:" + strconv.Itoa(b.Port()))
+
+	go dialed.Write([]byte("ping"))
+	received := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, received); err != nil || string(received) != "ping" {
+		t.Errorf("Expected to receive ping over IPv6, got %q, %v", received, err)
+	}
+}
+
+// Datagrams that are not uTP packets are passed on to the packet conn
+func TestPacketConn(t *testing.T) {
+	a := newTestSocket(t)
+	client, _ := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.Port()})
+	defer client.Close()
+
+	packetConn := a.PacketConn()
+	client.Write([]byte("d1:y1:qe"))
+	buffer := make([]byte, 64)
+	n, from, err := packetConn.ReadFrom(buffer)
+	if err != nil || string(buffer[:n]) != "d1:y1:qe" {
+		t.Fatalf("Expected the datagram to be passed on, got %q, %v", buffer[:n], err)
+	}
+
+	packetConn.WriteTo([]byte("reply"), from)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = client.Read(buffer)
+	if err != nil || string(buffer[:n]) != "reply" {
+		t.Errorf("Expected the reply through the socket, got %q, %v", buffer[:n], err)
+	}
+
+	// Closing the packet conn leaves the socket open
+	packetConn.Close()
+	if _, _, err := packetConn.ReadFrom(buffer); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected reads after closing to fail, got %v", err)
+	}
+	b := newTestSocket(t)
+	newTestConns(t, b, a, socketAddress(a))
+}